@@ -10,6 +10,7 @@ import (
 
 	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/cache"
+	"github.com/canonical/chisel/internal/deb"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/slicer"
 )
@@ -54,10 +55,22 @@ func (cmd *cmdCut) Execute(args []string) error {
 		sliceKeys[i] = sliceKey
 	}
 
-	var release *setup.Release
 	var err error
+	arch := cmd.Arch
+	if arch == "" {
+		arch, err = deb.InferArch()
+	} else {
+		err = deb.ValidateArch(arch)
+	}
+	if err != nil {
+		return err
+	}
+
+	var release *setup.Release
 	if strings.Contains(cmd.Release, "/") {
-		release, err = setup.ReadRelease(cmd.Release)
+		release, err = setup.ReadReleaseWithOptions(cmd.Release, &setup.ReadOptions{
+			Arch: arch,
+		})
 	} else {
 		var label, version string
 		if cmd.Release == "" {
@@ -71,13 +84,19 @@ func (cmd *cmdCut) Execute(args []string) error {
 		release, err = setup.FetchRelease(&setup.FetchOptions{
 			Label:   label,
 			Version: version,
+			Arch:    arch,
 		})
 	}
 	if err != nil {
 		return err
 	}
 
-	selection, err := setup.Select(release, sliceKeys)
+	// Check the selection before opening the archives, which may need to
+	// download their indexes. It is then redone with the opened archives
+	// so that packages come from the archive with the highest priority.
+	_, err = setup.SelectWithOptions(release, sliceKeys, &setup.SelectOptions{
+		Arch: arch,
+	})
 	if err != nil {
 		return err
 	}
@@ -87,10 +106,13 @@ func (cmd *cmdCut) Execute(args []string) error {
 		openArchive, err := archive.Open(&archive.Options{
 			Label:      archiveName,
 			Version:    archiveInfo.Version,
-			Arch:       cmd.Arch,
+			Arch:       arch,
 			Suites:     archiveInfo.Suites,
 			Components: archiveInfo.Components,
 			CacheDir:   cache.DefaultDir("chisel"),
+
+			Distribution: archiveInfo.Distribution,
+			URL:          archiveInfo.URL,
 		})
 		if err != nil {
 			return err
@@ -98,6 +120,14 @@ func (cmd *cmdCut) Execute(args []string) error {
 		archives[archiveName] = openArchive
 	}
 
+	selection, err := setup.SelectWithOptions(release, sliceKeys, &setup.SelectOptions{
+		Archives: archives,
+		Arch:     arch,
+	})
+	if err != nil {
+		return err
+	}
+
 	return slicer.Run(&slicer.RunOptions{
 		Selection: selection,
 		Archives:  archives,
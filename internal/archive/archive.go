@@ -26,6 +26,13 @@ type Options struct {
 	Suites     []string
 	Components []string
 	CacheDir   string
+
+	// Distribution is either "ubuntu", the default, or "debian".
+	Distribution string
+
+	// URL is the base URL of the archive. It defaults to the official
+	// Ubuntu mirrors, and must be provided for other distributions.
+	URL string
 }
 
 func Open(options *Options) (Archive, error) {
@@ -38,6 +45,16 @@ func Open(options *Options) (Archive, error) {
 	if err != nil {
 		return nil, err
 	}
+	switch options.Distribution {
+	case "", "ubuntu":
+	case "debian":
+		if options.URL == "" {
+			return nil, fmt.Errorf("archive options missing url")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported archive distribution: %q", options.Distribution)
+	}
+	// Debian archives share the layout of Ubuntu ones.
 	return openUbuntu(options)
 }
 
@@ -68,6 +85,9 @@ type ubuntuIndex struct {
 	release   control.Section
 	packages  control.File
 	cache     *cache.Cache
+
+	distribution string
+	baseURL      string
 }
 
 func (a *ubuntuArchive) Options() *Options {
@@ -146,6 +166,9 @@ func openUbuntu(options *Options) (Archive, error) {
 				component: component,
 				release:   release,
 				cache:     archive.cache,
+
+				distribution: options.Distribution,
+				baseURL:      options.URL,
 			}
 			if release == nil {
 				err := index.fetchRelease()
@@ -180,11 +203,19 @@ func (index *ubuntuIndex) fetchRelease() error {
 	if err != nil {
 		return fmt.Errorf("parsing archive Release file: %v", err)
 	}
-	section := ctrl.Section("Ubuntu")
-	if section == nil {
-		section = ctrl.Section("UbuntuProFIPS")
+	var section control.Section
+	if index.distribution == "debian" {
+		section = ctrl.Section("Debian")
+		if section == nil {
+			return fmt.Errorf("corrupted archive Release file: no Debian section")
+		}
+	} else {
+		section = ctrl.Section("Ubuntu")
 		if section == nil {
-			return fmt.Errorf("corrupted archive Release file: no Ubuntu section")
+			section = ctrl.Section("UbuntuProFIPS")
+			if section == nil {
+				return fmt.Errorf("corrupted archive Release file: no Ubuntu section")
+			}
 		}
 	}
 	logf("Release date: %s", section.Get("Date"))
@@ -240,9 +271,14 @@ func (index *ubuntuIndex) fetch(suffix, digest string) (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	baseURL := ubuntuURL
-	if index.arch != "amd64" && index.arch != "i386" {
-		baseURL = ubuntuPortsURL
+	baseURL := index.baseURL
+	if baseURL == "" {
+		baseURL = ubuntuURL
+		if index.arch != "amd64" && index.arch != "i386" {
+			baseURL = ubuntuPortsURL
+		}
+	} else if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
 	}
 
 	var url string
@@ -233,6 +233,62 @@ func (s *httpSuite) TestFetchPortsPackage(c *C) {
 	c.Assert(read(pkg), Equals, "mypkg4 1.4 data")
 }
 
+func (s *httpSuite) TestFetchDebianPackage(c *C) {
+
+	s.base = "http://deb.example.com/debian/"
+
+	release := s.prepareArchiveAdjustRelease("bookworm", "12", "arm64", []string{"main"}, func(release *testarchive.Release) {
+		release.Label = "Debian"
+	})
+	c.Assert(release.Label, Equals, "Debian")
+
+	options := archive.Options{
+		Label:        "debian",
+		Version:      "12",
+		Arch:         "arm64",
+		Suites:       []string{"bookworm"},
+		Components:   []string{"main"},
+		CacheDir:     c.MkDir(),
+		Distribution: "debian",
+		URL:          "http://deb.example.com/debian",
+	}
+
+	archive, err := archive.Open(&options)
+	c.Assert(err, IsNil)
+
+	pkg, err := archive.Fetch("mypkg1")
+	c.Assert(err, IsNil)
+	c.Assert(read(pkg), Equals, "mypkg1 1.1 data")
+}
+
+func (s *httpSuite) TestDebianOptionErrors(c *C) {
+	options := archive.Options{
+		Label:        "debian",
+		Version:      "12",
+		Arch:         "amd64",
+		Suites:       []string{"bookworm"},
+		Components:   []string{"main"},
+		CacheDir:     c.MkDir(),
+		Distribution: "debian",
+	}
+	_, err := archive.Open(&options)
+	c.Assert(err, ErrorMatches, "archive options missing url")
+
+	options.Distribution = "fedora"
+	_, err = archive.Open(&options)
+	c.Assert(err, ErrorMatches, `unsupported archive distribution: "fedora"`)
+
+	// Ubuntu archives must be announced as such.
+	s.prepareArchiveAdjustRelease("jammy", "22.04", "amd64", []string{"main"}, func(release *testarchive.Release) {
+		release.Label = "Debian"
+	})
+	options.Distribution = ""
+	options.Version = "22.04"
+	options.Suites = []string{"jammy"}
+	_, err = archive.Open(&options)
+	c.Assert(err, ErrorMatches, "corrupted archive Release file: no Ubuntu section")
+}
+
 func (s *httpSuite) TestFetchSecurityPackage(c *C) {
 
 	for i, suite := range []string{"jammy", "jammy-updates", "jammy-security"} {
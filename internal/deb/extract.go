@@ -32,6 +32,8 @@ type ExtractInfo struct {
 	Path     string
 	Mode     uint
 	Optional bool
+	UID      int
+	GID      int
 }
 
 func checkExtractOptions(options *ExtractOptions) error {
@@ -114,6 +116,10 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 		if pkgPath == "" {
 			return "", false
 		}
+		// Explicit paths take precedence over wildcards matching them.
+		if _, ok := options.Extract[pkgPath]; ok {
+			return "", true
+		}
 		pkgPathIsDir := pkgPath[len(pkgPath)-1] == '/'
 		for extractPath, extractInfos := range options.Extract {
 			if extractPath == "" {
@@ -124,8 +130,6 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 				if strdist.GlobPath(extractPath, pkgPath) {
 					return extractPath, true
 				}
-			case extractPath == pkgPath:
-				return "", true
 			case pkgPathIsDir:
 				for _, extractInfo := range extractInfos {
 					if strings.HasPrefix(extractInfo.Path, pkgPath) {
@@ -182,6 +186,12 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 			extractInfos, ok = options.Extract[sourcePath]
 			if ok {
 				delete(pendingPaths, sourcePath)
+				// Wildcards shadowed by the explicit path still matched content.
+				for extractPath := range pendingPaths {
+					if strings.ContainsAny(extractPath, "*?") && strdist.GlobPath(extractPath, sourcePath) {
+						delete(pendingPaths, extractPath)
+					}
+				}
 			} else {
 				// Base directory for extracted content. Relevant mainly to preserve
 				// the metadata, since the extracted content itself will also create
@@ -231,6 +241,8 @@ func extractData(dataReader io.Reader, options *ExtractOptions) error {
 				Mode: tarHeader.FileInfo().Mode(),
 				Data: pathReader,
 				Link: tarHeader.Linkname,
+				UID:  extractInfo.UID,
+				GID:  extractInfo.GID,
 			})
 			if err != nil {
 				return err
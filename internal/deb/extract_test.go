@@ -158,6 +158,33 @@ var extractTests = []extractTest{{
 		"/etc/dp*/": []string{"/etc/dpkg/"},
 		"/etc/de**": []string{"/etc/debian_version", "/etc/default/"},
 	},
+}, {
+	summary: "Explicit paths take precedence over globs",
+	pkgdata: testutil.PackageData["base-files"],
+	options: deb.ExtractOptions{
+		Extract: map[string][]deb.ExtractInfo{
+			"/etc/dp*/": []deb.ExtractInfo{{
+				Path: "/etc/dp*/",
+			}},
+			"/etc/de**": []deb.ExtractInfo{{
+				Path: "/etc/de**",
+			}},
+			"/etc/debian_version": []deb.ExtractInfo{{
+				Path: "/etc/debian_version",
+				Mode: 0600,
+			}},
+		},
+	},
+	result: map[string]string{
+		"/etc/":               "dir 0755",
+		"/etc/dpkg/":          "dir 0755",
+		"/etc/default/":       "dir 0755",
+		"/etc/debian_version": "file 0600 cce26cfe",
+	},
+	globbed: map[string][]string{
+		"/etc/dp*/": []string{"/etc/dpkg/"},
+		"/etc/de**": []string{"/etc/default/"},
+	},
 }, {
 	summary: "Globbing must have matching source and target",
 	pkgdata: testutil.PackageData["base-files"],
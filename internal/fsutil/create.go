@@ -13,9 +13,22 @@ type CreateOptions struct {
 	Mode fs.FileMode
 	Data io.Reader
 	Link string
+
+	// Hardlink, if set, creates Path as a hard link to the existing
+	// file at Link, sharing its mode. Mode is then disregarded.
+	Hardlink bool
+
+	// UID and GID, when either is non-zero, set the ownership of the
+	// created path. They are ignored for hard links, which share the
+	// ownership of their target.
+	UID int
+	GID int
 }
 
 func Create(o *CreateOptions) error {
+	if o.Hardlink {
+		return createHardlink(o)
+	}
 	var err error
 	switch o.Mode & fs.ModeType {
 	case 0:
@@ -27,9 +40,22 @@ func Create(o *CreateOptions) error {
 	default:
 		err = fmt.Errorf("unsupported file type: %s", o.Path)
 	}
+	if err == nil && (o.UID != 0 || o.GID != 0) {
+		err = chown(o)
+	}
 	return err
 }
 
+func chown(o *CreateOptions) error {
+	debugf("Changing ownership: %s (uid %d, gid %d)", o.Path, o.UID, o.GID)
+	err := os.Lchown(o.Path, o.UID, o.GID)
+	if err != nil || o.Mode&fs.ModeSymlink != 0 {
+		return err
+	}
+	// Changing the owner may clear the setuid and setgid bits.
+	return os.Chmod(o.Path, o.Mode)
+}
+
 func createDir(o *CreateOptions) error {
 	debugf("Creating directory: %s (mode %#o)", o.Path, o.Mode)
 	err := os.MkdirAll(filepath.Dir(o.Path), 0755)
@@ -61,6 +87,19 @@ func createFile(o *CreateOptions) error {
 	return err
 }
 
+func createHardlink(o *CreateOptions) error {
+	debugf("Creating hard link: %s => %s", o.Path, o.Link)
+	err := os.MkdirAll(filepath.Dir(o.Path), 0755)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	err = os.Remove(o.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Link(o.Link, o.Path)
+}
+
 func createSymlink(o *CreateOptions) error {
 	debugf("Creating symlink: %s => %s", o.Path, o.Link)
 	err := os.MkdirAll(filepath.Dir(o.Path), 0755)
@@ -3,6 +3,8 @@ package fsutil_test
 import (
 	"bytes"
 	"io/fs"
+	"io/ioutil"
+	"os"
 	"path/filepath"
 	"syscall"
 
@@ -79,3 +81,29 @@ func (s *S) TestCreate(c *C) {
 		c.Assert(result, DeepEquals, test.result)
 	}
 }
+
+func (s *S) TestCreateHardlink(c *C) {
+	dir := c.MkDir()
+	target := filepath.Join(dir, "target")
+	err := ioutil.WriteFile(target, []byte("data1"), 0640)
+	c.Assert(err, IsNil)
+
+	err = fsutil.Create(&fsutil.CreateOptions{
+		Path:     filepath.Join(dir, "foo/bar"),
+		Link:     target,
+		Mode:     0644,
+		Hardlink: true,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(testutil.TreeDump(dir), DeepEquals, map[string]string{
+		"/foo/":    "dir 0755",
+		"/foo/bar": "file 0640 5b41362b",
+		"/target":  "file 0640 5b41362b",
+	})
+
+	targetInfo, err := os.Stat(target)
+	c.Assert(err, IsNil)
+	linkInfo, err := os.Stat(filepath.Join(dir, "foo/bar"))
+	c.Assert(err, IsNil)
+	c.Assert(os.SameFile(targetInfo, linkInfo), Equals, true)
+}
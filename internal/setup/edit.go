@@ -0,0 +1,100 @@
+package setup
+
+import (
+	"bytes"
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RenameSliceInFile renames the slice old to new in the provided package
+// slice definitions, also updating essential references to it from the
+// package and from other slices in the same file. Packages including other
+// files are refused, as those may also refer to the slice. The document is
+// edited as a YAML node tree so that comments are preserved, although the
+// indentation may be changed.
+func RenameSliceInFile(data []byte, old, new string) ([]byte, error) {
+	if !snameExp.MatchString(new) {
+		return nil, fmt.Errorf("invalid slice name: %q", new)
+	}
+
+	var doc yaml.Node
+	err := yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse slice definitions: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("cannot parse slice definitions: expected a mapping")
+	}
+	top := doc.Content[0]
+
+	pkgNode := mappingValue(top, "package")
+	if pkgNode == nil || pkgNode.Kind != yaml.ScalarNode {
+		return nil, fmt.Errorf("cannot find package name in slice definitions")
+	}
+	if mappingValue(top, "include") != nil {
+		return nil, fmt.Errorf("cannot rename slice in package with included files")
+	}
+	slicesNode := mappingValue(top, "slices")
+	if slicesNode == nil || slicesNode.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("slice %q not found", old)
+	}
+
+	var oldKey *yaml.Node
+	for i := 0; i < len(slicesNode.Content); i += 2 {
+		key := slicesNode.Content[i]
+		switch key.Value {
+		case old:
+			oldKey = key
+		case new:
+			return nil, fmt.Errorf("slice %q already exists", new)
+		}
+	}
+	if oldKey == nil {
+		return nil, fmt.Errorf("slice %q not found", old)
+	}
+	oldKey.Value = new
+
+	oldRef := pkgNode.Value + "_" + old
+	newRef := pkgNode.Value + "_" + new
+	renameRefs := func(essential *yaml.Node) {
+		if essential == nil || essential.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, ref := range essential.Content {
+			if ref.Kind == yaml.ScalarNode && ref.Value == oldRef {
+				ref.Value = newRef
+			}
+		}
+	}
+	renameRefs(mappingValue(top, "essential"))
+	for i := 1; i < len(slicesNode.Content); i += 2 {
+		renameRefs(mappingValue(slicesNode.Content[i], "essential"))
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err == nil {
+		err = encoder.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode slice definitions: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// mappingValue returns the value for key in the mapping node, or nil if
+// node is nil, is not a mapping, or has no such key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package setup_test
+
+import (
+	. "gopkg.in/check.v1"
+
+	"strings"
+
+	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/testutil"
+)
+
+var renameSliceTests = []struct {
+	summary string
+	input   string
+	old     string
+	new     string
+	output  string
+	error   string
+}{{
+	summary: "Rename updates essential references in the same file",
+	input: `
+		# Package comment.
+		package: mypkg
+		slices:
+		  # Slice comment.
+		  myslice1:
+		    contents:
+		      /usr/bin/tool: # Path comment.
+		  myslice2:
+		    essential:
+		      - mypkg_myslice1 # Reference comment.
+		      - otherpkg_myslice1
+	`,
+	old: "myslice1",
+	new: "bins",
+	output: `
+		# Package comment.
+		package: mypkg
+		slices:
+		  # Slice comment.
+		  bins:
+		    contents:
+		      /usr/bin/tool: # Path comment.
+		  myslice2:
+		    essential:
+		      - mypkg_bins # Reference comment.
+		      - otherpkg_myslice1
+	`,
+}, {
+	summary: "Rename updates package essential references",
+	input: `
+		package: mypkg
+		essential:
+		  - mypkg_myslice1
+		  - otherpkg_myslice1
+		slices:
+		  myslice1: {}
+		  myslice2: {}
+	`,
+	old: "myslice1",
+	new: "base",
+	output: `
+		package: mypkg
+		essential:
+		  - mypkg_base
+		  - otherpkg_myslice1
+		slices:
+		  base: {}
+		  myslice2: {}
+	`,
+}, {
+	summary: "Packages with included files are refused",
+	input: `
+		package: mypkg
+		include:
+		  - mypkg-extra.yaml
+		slices:
+		  myslice1: {}
+	`,
+	old:   "myslice1",
+	new:   "base",
+	error: `cannot rename slice in package with included files`,
+}, {
+	summary: "Missing slice",
+	input: `
+		package: mypkg
+		slices:
+		  myslice1: {}
+	`,
+	old:   "myslice2",
+	new:   "myslice3",
+	error: `slice "myslice2" not found`,
+}, {
+	summary: "New name already in use",
+	input: `
+		package: mypkg
+		slices:
+		  myslice1: {}
+		  myslice2: {}
+	`,
+	old:   "myslice1",
+	new:   "myslice2",
+	error: `slice "myslice2" already exists`,
+}, {
+	summary: "Invalid new name",
+	input: `
+		package: mypkg
+		slices:
+		  myslice1: {}
+	`,
+	old:   "myslice1",
+	new:   "MySlice",
+	error: `invalid slice name: "MySlice"`,
+}}
+
+func (s *S) TestRenameSliceInFile(c *C) {
+	for _, test := range renameSliceTests {
+		c.Logf("Summary: %s", test.summary)
+		output, err := setup.RenameSliceInFile(testutil.Reindent(test.input), test.old, test.new)
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+			continue
+		}
+		c.Assert(err, IsNil)
+		expected := strings.TrimSpace(string(testutil.Reindent(test.output))) + "\n"
+		c.Assert(string(output), Equals, expected)
+	}
+}
@@ -0,0 +1,9 @@
+package setup
+
+func FakeReleaseLimits(download, bytes int64, files int) (restore func()) {
+	oldDownload, oldBytes, oldFiles := maxReleaseDownload, maxReleaseBytes, maxReleaseFiles
+	maxReleaseDownload, maxReleaseBytes, maxReleaseFiles = download, bytes, files
+	return func() {
+		maxReleaseDownload, maxReleaseBytes, maxReleaseFiles = oldDownload, oldBytes, oldFiles
+	}
+}
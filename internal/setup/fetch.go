@@ -2,12 +2,18 @@ package setup
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -21,6 +27,7 @@ import (
 type FetchOptions struct {
 	Label    string
 	Version  string
+	Arch     string
 	CacheDir string
 }
 
@@ -106,7 +113,159 @@ func FetchRelease(options *FetchOptions) (*Release, error) {
 		}
 	}
 
-	return ReadRelease(dirName)
+	return ReadReleaseWithOptions(dirName, &ReadOptions{
+		Arch: options.Arch,
+	})
+}
+
+// ReadReleaseURL fetches the release tarball at url and reads the release
+// in it. The tarball must be gzip-compressed, with the release content
+// under a single top-level directory as in archives generated by GitHub.
+// The tarball is extracted within fixed size limits, and may only hold
+// regular files and directories.
+// If url has a fragment in the form "sha256=<hex digest>", the downloaded
+// data must match that checksum. The resulting release has its Path set
+// to url without the fragment.
+func ReadReleaseURL(ctx context.Context, url string) (*Release, error) {
+	logf("Fetching release from %s...", url)
+
+	var checksum string
+	if pos := strings.IndexByte(url, '#'); pos >= 0 {
+		fragment := url[pos+1:]
+		url = url[:pos]
+		if !strings.HasPrefix(fragment, "sha256=") {
+			return nil, fmt.Errorf("invalid release URL fragment: %q", fragment)
+		}
+		checksum = strings.ToLower(fragment[len("sha256="):])
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request for release: %w", err)
+	}
+	resp, err := bulkClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("cannot fetch release from %s: %v", url, resp.Status)
+	}
+
+	// Read one byte past the limit to tell whether it was exceeded.
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxReleaseDownload+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch release from %s: %w", url, err)
+	}
+	if int64(len(data)) > maxReleaseDownload {
+		return nil, fmt.Errorf("release from %s has more than %d bytes", url, maxReleaseDownload)
+	}
+	if checksum != "" {
+		sum := sha256.Sum256(data)
+		if digest := hex.EncodeToString(sum[:]); digest != checksum {
+			return nil, fmt.Errorf("release from %s has checksum %s, expected %s", url, digest, checksum)
+		}
+	}
+
+	dirName, err := ioutil.TempDir("", "chisel-release-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(dirName)
+
+	err = extractReleaseTarGz(bytes.NewReader(data), dirName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot extract release from %s: %w", url, err)
+	}
+	release, err := ReadReleaseWithOptions(dirName, &ReadOptions{
+		MaxTotalBytes: maxReleaseBytes,
+		MaxFiles:      maxReleaseFiles,
+	})
+	if err != nil {
+		return nil, err
+	}
+	release.Path = url
+	return release, nil
+}
+
+// Limits for releases fetched by ReadReleaseURL, which may come from
+// untrusted locations.
+var (
+	maxReleaseDownload int64 = 64 << 20
+	maxReleaseBytes    int64 = 256 << 20
+	maxReleaseFiles          = 10000
+)
+
+// extractReleaseTarGz extracts the gzip-compressed release tarball into
+// targetDir, dropping the top-level directory from its paths. Only regular
+// files and directories are accepted, so the tarball cannot reference
+// content outside of targetDir.
+func extractReleaseTarGz(dataReader io.Reader, targetDir string) error {
+	gzipReader, err := gzip.NewReader(dataReader)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+
+	var files int
+	var total int64
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		tarHeader, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if tarHeader.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		sourcePath := path.Clean(tarHeader.Name)
+		if pos := strings.IndexByte(sourcePath, '/'); pos <= 0 || sourcePath[0] == '.' {
+			continue
+		} else {
+			sourcePath = sourcePath[pos+1:]
+		}
+		if !fs.ValidPath(sourcePath) {
+			return fmt.Errorf("invalid path in release tarball: %s", tarHeader.Name)
+		}
+		targetPath := filepath.Join(targetDir, filepath.FromSlash(sourcePath))
+
+		mode := tarHeader.FileInfo().Mode()
+		switch {
+		case mode.IsDir():
+			err = os.MkdirAll(targetPath, 0755)
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			files++
+			if files > maxReleaseFiles {
+				return fmt.Errorf("release has more than %d files", maxReleaseFiles)
+			}
+			// Read one byte past the limit to tell whether it was exceeded.
+			data, err := ioutil.ReadAll(io.LimitReader(tarReader, maxReleaseBytes-total+1))
+			if err != nil {
+				return err
+			}
+			total += int64(len(data))
+			if total > maxReleaseBytes {
+				return fmt.Errorf("release has more than %d bytes", maxReleaseBytes)
+			}
+			err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(targetPath, data, 0644)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported entry in release tarball: %s", tarHeader.Name)
+		}
+	}
+	return nil
 }
 
 func extractTarGz(dataReader io.Reader, targetDir string) error {
@@ -3,11 +3,22 @@ package setup_test
 import (
 	. "gopkg.in/check.v1"
 
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 
 	"github.com/canonical/chisel/internal/setup"
+	"github.com/canonical/chisel/internal/testutil"
 )
 
 // TODO Implement local test server instead of using live repository.
@@ -49,3 +60,124 @@ func (s *S) TestFetch(c *C) {
 		}
 	}
 }
+
+func makeReleaseTarGz(c *C, input map[string]string) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for path, data := range input {
+		content := testutil.Reindent(data)
+		err := tarWriter.WriteHeader(&tar.Header{
+			Name: "chisel-releases-main/" + path,
+			Mode: 0644,
+			Size: int64(len(content)),
+		})
+		c.Assert(err, IsNil)
+		_, err = tarWriter.Write(content)
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tarWriter.Close(), IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	return buf.Bytes()
+}
+
+func (s *S) TestReadReleaseURL(c *C) {
+	data := makeReleaseTarGz(c, map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path:
+		`,
+	})
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/release.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+	mux.HandleFunc("/truncated.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	url := server.URL + "/release.tar.gz"
+	release, err := setup.ReadReleaseURL(context.Background(), url)
+	c.Assert(err, IsNil)
+	c.Assert(release.Path, Equals, url)
+	c.Assert(release.Archives["ubuntu"].Version, Equals, "22.04")
+	c.Assert(release.Packages["mypkg"].Slices["myslice"].Contents["/path"].Kind, Equals, setup.CopyPath)
+
+	release, err = setup.ReadReleaseURL(context.Background(), url+"#sha256="+digest)
+	c.Assert(err, IsNil)
+	c.Assert(release.Path, Equals, url)
+
+	_, err = setup.ReadReleaseURL(context.Background(), url+"#sha256=0123")
+	c.Assert(err, ErrorMatches, `release from .* has checksum `+digest+`, expected 0123`)
+
+	_, err = setup.ReadReleaseURL(context.Background(), url+"#md5=0123")
+	c.Assert(err, ErrorMatches, `invalid release URL fragment: "md5=0123"`)
+
+	_, err = setup.ReadReleaseURL(context.Background(), server.URL+"/missing.tar.gz")
+	c.Assert(err, ErrorMatches, `cannot fetch release from .*/missing.tar.gz: 404 Not Found`)
+
+	_, err = setup.ReadReleaseURL(context.Background(), server.URL+"/truncated.tar.gz")
+	c.Assert(err, ErrorMatches, `cannot fetch release from .*/truncated.tar.gz: unexpected EOF`)
+}
+
+func (s *S) TestReadReleaseURLUntrusted(c *C) {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	tarWriter := tar.NewWriter(gzipWriter)
+	err := tarWriter.WriteHeader(&tar.Header{
+		Name:     "chisel-releases-main/slices",
+		Typeflag: tar.TypeSymlink,
+		Linkname: "/etc",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(tarWriter.Close(), IsNil)
+	c.Assert(gzipWriter.Close(), IsNil)
+	symlinkData := buf.Bytes()
+
+	releaseData := makeReleaseTarGz(c, map[string]string{
+		"chisel.yaml":             string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": "package: mypkg\n",
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/symlink.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(symlinkData)
+	})
+	mux.HandleFunc("/release.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(releaseData)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	_, err = setup.ReadReleaseURL(context.Background(), server.URL+"/symlink.tar.gz")
+	c.Assert(err, ErrorMatches, `cannot extract release from .*: unsupported entry in release tarball: chisel-releases-main/slices`)
+
+	url := server.URL + "/release.tar.gz"
+	restore := setup.FakeReleaseLimits(int64(len(releaseData)-1), 1<<20, 10)
+	_, err = setup.ReadReleaseURL(context.Background(), url)
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`release from .* has more than %d bytes`, len(releaseData)-1))
+	restore()
+
+	restore = setup.FakeReleaseLimits(1<<20, 10, 10)
+	_, err = setup.ReadReleaseURL(context.Background(), url)
+	c.Assert(err, ErrorMatches, `cannot extract release from .*: release has more than 10 bytes`)
+	restore()
+
+	restore = setup.FakeReleaseLimits(1<<20, 1<<20, 1)
+	_, err = setup.ReadReleaseURL(context.Background(), url)
+	c.Assert(err, ErrorMatches, `cannot extract release from .*: release has more than 1 files`)
+	restore()
+
+	_, err = setup.ReadReleaseURL(context.Background(), url)
+	c.Assert(err, IsNil)
+}
@@ -0,0 +1,147 @@
+package setup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+type jsonRelease struct {
+	DefaultArchive string                  `json:"default-archive"`
+	Archives       map[string]*jsonArchive `json:"archives"`
+	Packages       map[string]*jsonPackage `json:"packages"`
+	Replaces       map[string]string       `json:"replaces,omitempty"`
+}
+
+type jsonArchive struct {
+	Version      string   `json:"version"`
+	Suites       []string `json:"suites"`
+	Components   []string `json:"components"`
+	URL          string   `json:"url,omitempty"`
+	Priority     int      `json:"priority,omitempty"`
+	Distribution string   `json:"distribution"`
+}
+
+type jsonPackage struct {
+	Path          string                `json:"path"`
+	Archive       string                `json:"archive"`
+	Pinned        bool                  `json:"pinned,omitempty"`
+	MaxTotalFiles int                   `json:"max-total-files,omitempty"`
+	Slices        map[string]*jsonSlice `json:"slices"`
+}
+
+type jsonSlice struct {
+	Essential []string             `json:"essential,omitempty"`
+	Contents  map[string]*jsonPath `json:"contents,omitempty"`
+	Mutate    string               `json:"mutate,omitempty"`
+
+	Deprecated   *jsonDeprecated `json:"deprecated,omitempty"`
+	Experimental bool            `json:"experimental,omitempty"`
+}
+
+type jsonDeprecated struct {
+	Since   string `json:"since,omitempty"`
+	Message string `json:"message"`
+}
+
+type jsonPath struct {
+	Kind    PathKind  `json:"kind"`
+	Info    string    `json:"info,omitempty"`
+	Mode    uint      `json:"mode,omitempty"`
+	UID     int       `json:"uid,omitempty"`
+	GID     int       `json:"gid,omitempty"`
+	Mutable bool      `json:"mutable,omitempty"`
+	Until   PathUntil `json:"until,omitempty"`
+	Arch    []string  `json:"arch,omitempty"`
+	Append  bool      `json:"append,omitempty"`
+}
+
+// MarshalJSON returns a JSON representation of the parsed release, with its
+// archives, packages, slices, and their contents. Objects are keyed by name
+// or path and keys are sorted, so the output is stable for a given release.
+// The location the release was read from is not included.
+func (r *Release) MarshalJSON() ([]byte, error) {
+	jrelease := &jsonRelease{
+		DefaultArchive: r.DefaultArchive,
+		Archives:       make(map[string]*jsonArchive, len(r.Archives)),
+		Packages:       make(map[string]*jsonPackage, len(r.Packages)),
+		Replaces:       r.Replaces,
+	}
+	for name, archive := range r.Archives {
+		jrelease.Archives[name] = &jsonArchive{
+			Version:      archive.Version,
+			Suites:       archive.Suites,
+			Components:   archive.Components,
+			URL:          archive.URL,
+			Priority:     archive.Priority,
+			Distribution: archive.Distribution,
+		}
+	}
+	for name, pkg := range r.Packages {
+		jpkg := &jsonPackage{
+			Path:          pkg.Path,
+			Archive:       pkg.Archive,
+			Pinned:        pkg.Pinned,
+			MaxTotalFiles: pkg.MaxTotalFiles,
+			Slices:        make(map[string]*jsonSlice, len(pkg.Slices)),
+		}
+		for sliceName, slice := range pkg.Slices {
+			jslice := &jsonSlice{
+				Mutate:       slice.Scripts.Mutate,
+				Experimental: slice.Experimental,
+			}
+			if slice.Deprecated != nil {
+				jslice.Deprecated = &jsonDeprecated{
+					Since:   slice.Deprecated.Since,
+					Message: slice.Deprecated.Message,
+				}
+			}
+			for _, key := range slice.Essential {
+				jslice.Essential = append(jslice.Essential, key.String())
+			}
+			if len(slice.Contents) > 0 {
+				jslice.Contents = make(map[string]*jsonPath, len(slice.Contents))
+			}
+			for path, info := range slice.Contents {
+				jslice.Contents[path] = &jsonPath{
+					Kind:    info.Kind,
+					Info:    info.Info,
+					Mode:    info.Mode,
+					UID:     info.UID,
+					GID:     info.GID,
+					Mutable: info.Mutable,
+					Until:   info.Until,
+					Arch:    info.Arch,
+					Append:  info.Append,
+				}
+			}
+			jpkg.Slices[sliceName] = jslice
+		}
+		jrelease.Packages[name] = jpkg
+	}
+	return json.Marshal(jrelease)
+}
+
+type jsonSelection struct {
+	Release *Release `json:"release"`
+	Slices  []string `json:"slices"`
+}
+
+// Fingerprint returns a stable hash identifying the selection. It covers
+// the complete release definition, including the archives and their
+// versions, and the selected slices in their order.
+func (s *Selection) Fingerprint() (string, error) {
+	jselection := &jsonSelection{
+		Release: s.Release,
+		Slices:  make([]string, len(s.Slices)),
+	}
+	for i, slice := range s.Slices {
+		jselection.Slices[i] = slice.String()
+	}
+	data, err := json.Marshal(jselection)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,119 @@
+package setup_test
+
+import (
+	"encoding/json"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/canonical/chisel/internal/setup"
+)
+
+func (s *S) TestReleaseMarshalJSON(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: data, mode: 0600}
+						/usr/bin/tool:
+				myslice2:
+					experimental: true
+					essential:
+						- mypkg1_myslice1
+						- mypkg2_myslice1
+					mutate: |
+						pass
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			archive: ubuntu
+			max-total-files: 10
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/*.so: {arch: [amd64, arm64]}
+		`,
+	})
+
+	data, err := json.Marshal(release)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, `{`+
+		`"default-archive":"ubuntu",`+
+		`"archives":{"ubuntu":{"version":"22.04","suites":["jammy"],"components":["main","universe"],"distribution":"ubuntu"}},`+
+		`"packages":{`+
+		`"mypkg1":{"path":"slices/mydir/mypkg1.yaml","archive":"ubuntu","slices":{`+
+		`"myslice1":{"contents":{`+
+		`"/etc/config":{"kind":"text","info":"data","mode":384},`+
+		`"/usr/bin/tool":{"kind":"copy"}}},`+
+		`"myslice2":{"essential":["mypkg1_myslice1","mypkg2_myslice1"],"mutate":"pass\n","experimental":true}}},`+
+		`"mypkg2":{"path":"slices/mydir/mypkg2.yaml","archive":"ubuntu","pinned":true,"max-total-files":10,"slices":{`+
+		`"myslice1":{"contents":{"/usr/lib/*.so":{"kind":"glob","arch":["amd64","arm64"]}}}}}}}`)
+
+	for i := 0; i < 10; i++ {
+		again, err := json.Marshal(release)
+		c.Assert(err, IsNil)
+		c.Assert(again, DeepEquals, data)
+	}
+
+	var decoded map[string]interface{}
+	err = json.Unmarshal(data, &decoded)
+	c.Assert(err, IsNil)
+	for _, key := range []string{"default-archive", "archives", "packages"} {
+		c.Assert(decoded[key], NotNil)
+	}
+}
+
+func (s *S) TestSelectionFingerprint(c *C) {
+	input := map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+				myslice2:
+					essential:
+						- mypkg1_myslice1
+				myslice3:
+					contents:
+						/usr/bin/other:
+		`,
+	}
+	release := readRelease(c, input)
+
+	fingerprint := func(release *setup.Release, keys ...setup.SliceKey) string {
+		selection, err := setup.Select(release, keys)
+		c.Assert(err, IsNil)
+		fingerprint, err := selection.Fingerprint()
+		c.Assert(err, IsNil)
+		return fingerprint
+	}
+
+	first := fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"})
+	c.Assert(first, Matches, "[0-9a-f]{64}")
+	for i := 0; i < 10; i++ {
+		c.Assert(fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"}), Equals, first)
+	}
+
+	// Reading the same release again gives the same result.
+	c.Assert(fingerprint(readRelease(c, input), setup.SliceKey{"mypkg1", "myslice2"}), Equals, first)
+
+	// A different selection changes the fingerprint.
+	c.Assert(fingerprint(release, setup.SliceKey{"mypkg1", "myslice1"}), Not(Equals), first)
+
+	// So do changes to package and slice properties.
+	release.Packages["mypkg1"].Pinned = true
+	pinned := fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"})
+	c.Assert(pinned, Not(Equals), first)
+	release.Packages["mypkg1"].MaxTotalFiles = 10
+	limited := fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"})
+	c.Assert(limited, Not(Equals), pinned)
+	release.Packages["mypkg1"].Slices["myslice3"].Experimental = true
+	c.Assert(fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"}), Not(Equals), limited)
+
+	// And a different archive version.
+	release = readRelease(c, input)
+	release.Archives["ubuntu"].Version = "22.10"
+	c.Assert(fingerprint(release, setup.SliceKey{"mypkg1", "myslice2"}), Not(Equals), first)
+}
@@ -2,15 +2,26 @@ package setup
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
+	"go.starlark.net/syntax"
 	"gopkg.in/yaml.v3"
 
+	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/deb"
 	"github.com/canonical/chisel/internal/strdist"
 )
@@ -22,14 +33,37 @@ type Release struct {
 	Packages       map[string]*Package
 	Archives       map[string]*Archive
 	DefaultArchive string
+
+	// Replaces maps path prefixes to the package that takes over the
+	// paths under them when slices from several packages declare them.
+	Replaces map[string]string
+
+	// Warnings holds non-fatal issues found while reading the release
+	// by the advisory checks enabled in ReadOptions.
+	Warnings []string
 }
 
 // Archive is the location from which binary packages are obtained.
 type Archive struct {
-	Name       string
-	Version    string
-	Suites     []string
+	Name    string
+	Version string
+	Suites  []string
+
+	// Components holds the archive components in the order they were
+	// declared, which is significant and is preserved as is.
 	Components []string
+
+	// Distribution holds the distribution targeted by the archive, either
+	// "ubuntu", the default, or "debian".
+	Distribution string
+
+	// URL holds the base URL of the archive. It may be empty for Ubuntu
+	// archives, which default to the official Ubuntu mirrors.
+	URL string
+
+	// Priority decides which archive a package is obtained from when it's
+	// available in several of them. Higher values take precedence.
+	Priority int
 }
 
 // Package holds a collection of slices that represent parts of themselves.
@@ -38,6 +72,136 @@ type Package struct {
 	Path    string
 	Archive string
 	Slices  map[string]*Slice
+
+	// Pinned is set when the archive was explicitly selected in the slice
+	// definitions, in which case the package is always obtained from it.
+	Pinned bool
+
+	// MaxTotalFiles limits the number of distinct paths extracted by all
+	// the package slices together, as checked by CheckTotalFiles. Zero
+	// means no limit.
+	MaxTotalFiles int
+}
+
+// FileLister provides the list of paths shipped by packages. Directory
+// paths end with a slash.
+type FileLister interface {
+	Files(pkg string) []string
+}
+
+// ActiveSlices returns the sorted names of the package slices that would
+// extract at least one of the files shipped by the package, according to
+// the provider. Content not coming from the package, such as text,
+// symlinks and directories made by Chisel, is not considered.
+func (p *Package) ActiveSlices(provider FileLister) []string {
+	files := provider.Files(p.Name)
+	var active []string
+	for name, slice := range p.Slices {
+		found := false
+		for contPath, info := range slice.Contents {
+			switch info.Kind {
+			case CopyPath:
+				if info.Info != "" {
+					contPath = info.Info
+				}
+			case GlobPath:
+			default:
+				continue
+			}
+			for _, file := range files {
+				if file == contPath || info.Kind == GlobPath && strdist.GlobPath(contPath, file) {
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if found {
+			active = append(active, name)
+		}
+	}
+	sort.Strings(active)
+	return active
+}
+
+// TotalFiles returns the number of distinct paths extracted by all the
+// package slices together, with wildcard paths resolved against the files
+// shipped by the package according to the provider.
+func (p *Package) TotalFiles(provider FileLister) int {
+	files := provider.Files(p.Name)
+	paths := make(map[string]bool)
+	for _, slice := range p.Slices {
+		for contPath, info := range slice.Contents {
+			if info.Kind != GlobPath {
+				paths[contPath] = true
+				continue
+			}
+			for _, file := range files {
+				if strdist.GlobPath(contPath, file) {
+					paths[file] = true
+				}
+			}
+		}
+	}
+	return len(paths)
+}
+
+// CheckTotalFiles returns an error if the package slices together extract
+// more paths than allowed by MaxTotalFiles, according to the provider.
+func (p *Package) CheckTotalFiles(provider FileLister) error {
+	if p.MaxTotalFiles == 0 {
+		return nil
+	}
+	if total := p.TotalFiles(provider); total > p.MaxTotalFiles {
+		return fmt.Errorf("package %s slices have %d files, more than the maximum of %d",
+			p.Name, total, p.MaxTotalFiles)
+	}
+	return nil
+}
+
+// expandEssentials replaces the <package>_* entries in the essentials of
+// all slices with every slice defined for that package, except for the
+// requiring slice itself. Wildcards for packages without slices are
+// passed to report and dropped.
+func expandEssentials(release *Release, report func(err error) error) error {
+	for _, slice := range release.sortedSlices() {
+		var essential []SliceKey
+		seen := make(map[SliceKey]bool)
+		add := func(key SliceKey) {
+			if !seen[key] {
+				seen[key] = true
+				essential = append(essential, key)
+			}
+		}
+		for _, req := range slice.Essential {
+			if req.Slice != "*" {
+				add(req)
+				continue
+			}
+			pkg, ok := release.Packages[req.Package]
+			if !ok || len(pkg.Slices) == 0 {
+				err := report(fmt.Errorf("%s requires %s, but package has no slices", slice, req))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			names := make([]string, 0, len(pkg.Slices))
+			for name := range pkg.Slices {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if key := (SliceKey{req.Package, name}); key != (SliceKey{slice.Package, slice.Name}) {
+					add(key)
+				}
+			}
+		}
+		slice.Essential = essential
+	}
+	return nil
 }
 
 // Slice holds the details about a package slice.
@@ -47,6 +211,20 @@ type Slice struct {
 	Essential []SliceKey
 	Contents  map[string]PathInfo
 	Scripts   SliceScripts
+
+	// Deprecated is set when the slice should no longer be used.
+	Deprecated *SliceDeprecation
+
+	// Experimental slices are only selected, whether directly or as
+	// essentials, when SelectOptions.AllowExperimental is set.
+	Experimental bool
+}
+
+// SliceDeprecation holds the details about a deprecated slice.
+type SliceDeprecation struct {
+	// Since holds the release version the slice was deprecated in, if known.
+	Since   string
+	Message string
 }
 
 type SliceScripts struct {
@@ -56,12 +234,26 @@ type SliceScripts struct {
 type PathKind string
 
 const (
-	DirPath     PathKind = "dir"
-	CopyPath    PathKind = "copy"
+	DirPath  PathKind = "dir"
+	CopyPath PathKind = "copy"
+
+	// GlobPath is used for content paths with wildcards, which extract
+	// every matching path from the package. A ? matches any one character
+	// and * matches any number of characters, both within a single path
+	// component, while ** matches any number of characters across path
+	// components. A glob matching nothing in the package is not an error.
+	// Globs from different packages may overlap, and only conflict on the
+	// files shipped by both packages, as checked by SelectWithOptions when
+	// a file provider is available.
 	GlobPath    PathKind = "glob"
 	TextPath    PathKind = "text"
 	SymlinkPath PathKind = "symlink"
 
+	// HardlinkPath is used for paths created as a hard link to the
+	// regular file at the absolute path in Info, which must be provided
+	// by a slice in the same selection.
+	HardlinkPath PathKind = "hardlink"
+
 	// TODO Maybe in the future, for binary support.
 	//Base64Path PathKind = "base64"
 )
@@ -78,9 +270,17 @@ type PathInfo struct {
 	Info string
 	Mode uint
 
+	// UID and GID hold the ownership of the path, with zero for root.
+	UID int
+	GID int
+
 	Mutable bool
 	Until   PathUntil
 	Arch    []string
+
+	// Append is set for text paths whose content is appended to the text
+	// from all other slices appending to the same path, in selection order.
+	Append bool
 }
 
 // SameContent returns whether the path has the same content properties as some
@@ -91,9 +291,63 @@ func (pi *PathInfo) SameContent(other *PathInfo) bool {
 	return (pi.Kind == other.Kind &&
 		pi.Info == other.Info &&
 		pi.Mode == other.Mode &&
+		pi.UID == other.UID &&
+		pi.GID == other.GID &&
 		pi.Mutable == other.Mutable)
 }
 
+// Included returns whether the path is part of the content when slicing
+// for the given architecture. All content qualifiers are evaluated here,
+// and the path is only included when every one of them is satisfied.
+func (pi *PathInfo) Included(arch string) bool {
+	if len(pi.Arch) > 0 {
+		found := false
+		for _, a := range pi.Arch {
+			if a == arch {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// disjointArch returns whether the two architecture lists restrict the
+// respective paths to architectures that never overlap.
+func disjointArch(a, b []string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// conflicts returns whether two slices declaring the same path, with the
+// respective path information, are in conflict. Paths that are never
+// included for the same architecture do not conflict.
+func conflicts(old *Slice, oldInfo *PathInfo, new *Slice, newInfo *PathInfo) bool {
+	if disjointArch(oldInfo.Arch, newInfo.Arch) {
+		return false
+	}
+	if oldInfo.Append || newInfo.Append {
+		return !oldInfo.Append || !newInfo.Append ||
+			oldInfo.Mode != newInfo.Mode || oldInfo.Mutable != newInfo.Mutable ||
+			oldInfo.UID != newInfo.UID || oldInfo.GID != newInfo.GID
+	}
+	// Identical wildcards from different packages only conflict on the
+	// files shipped by both, as checked by checkGlobFiles.
+	return !newInfo.SameContent(oldInfo) || newInfo.Kind == CopyPath && new.Package != old.Package
+}
+
 type SliceKey struct {
 	Package string
 	Slice   string
@@ -108,518 +362,3073 @@ func (s SliceKey) String() string { return s.Package + "_" + s.Slice }
 // paths could potentially be missing, for example.
 type Selection struct {
 	Release *Release
-	Slices  []*Slice
+
+	// Slices holds the selected slices with every slice after all of its
+	// essentials, and otherwise sorted by package and slice name.
+	Slices []*Slice
+
+	// PackageArchives holds the name of the archive each selected package
+	// was resolved to when selecting with archives. See ArchiveFor.
+	PackageArchives map[string]string
+
+	// Warnings holds non-fatal issues found while selecting the slices,
+	// such as the use of deprecated slices.
+	Warnings []string
+
+	// Reasons holds why each slice is in the selection, when selecting
+	// with SelectOptions.RecordReasons.
+	Reasons map[SliceKey]Reason
 }
 
-func ReadRelease(dir string) (*Release, error) {
-	logDir := dir
-	if strings.Contains(dir, "/.cache/") {
-		logDir = filepath.Base(dir)
-	}
-	logf("Processing %s release...", logDir)
+// Reason explains why a slice is part of a selection.
+type Reason struct {
+	// Requested is set when the slice was explicitly selected.
+	Requested bool
 
-	release := &Release{
-		Path:     dir,
-		Packages: make(map[string]*Package),
+	// RequiredBy holds the slice through which the slice was first
+	// reached as an essential, when it was not explicitly selected.
+	RequiredBy SliceKey
+}
+
+func (r Reason) String() string {
+	if r.Requested {
+		return "requested"
 	}
+	return "required by " + r.RequiredBy.String()
+}
 
-	release, err := readRelease(dir)
-	if err != nil {
-		return nil, err
+// RequiredBy returns the chain of slices that caused the provided slice to
+// be selected, starting with the slice that required it and ending with an
+// explicitly selected one. The chain is empty for slices that were selected
+// explicitly. The ok result is false when the reason for the slice is not
+// known, either because it is not in the selection or because the selection
+// was not made with SelectOptions.RecordReasons.
+func (s *Selection) RequiredBy(key SliceKey) (chain []SliceKey, ok bool) {
+	for {
+		reason, found := s.Reasons[key]
+		if !found {
+			// Every link in a recorded chain has a reason, so this can
+			// only happen for the slice that was asked about.
+			return nil, false
+		}
+		if reason.Requested {
+			return chain, true
+		}
+		key = reason.RequiredBy
+		chain = append(chain, key)
 	}
+}
 
-	err = release.validate()
-	if err != nil {
-		return nil, err
+// sortedSlices returns all slices in the release ordered by package
+// and slice name.
+func (r *Release) sortedSlices() []*Slice {
+	var slices []*Slice
+	for _, pkg := range r.Packages {
+		for _, slice := range pkg.Slices {
+			slices = append(slices, slice)
+		}
 	}
-	return release, nil
+	sort.Slice(slices, func(i, j int) bool {
+		if slices[i].Package != slices[j].Package {
+			return slices[i].Package < slices[j].Package
+		}
+		return slices[i].Name < slices[j].Name
+	})
+	return slices
 }
 
-func (r *Release) validate() error {
-	keys := []SliceKey(nil)
-	paths := make(map[string]*Slice)
-	globs := make(map[string]*Slice)
+// FindSlices returns all slices in the release for which pred returns true,
+// ordered by package and slice name.
+func (r *Release) FindSlices(pred func(*Slice) bool) []*Slice {
+	var found []*Slice
+	for _, slice := range r.sortedSlices() {
+		if pred(slice) {
+			found = append(found, slice)
+		}
+	}
+	return found
+}
 
-	// Check for info conflicts and prepare for following checks.
-	for _, pkg := range r.Packages {
-		for _, new := range pkg.Slices {
-			keys = append(keys, SliceKey{pkg.Name, new.Name})
-			for newPath, newInfo := range new.Contents {
-				if old, ok := paths[newPath]; ok {
-					oldInfo := old.Contents[newPath]
-					if !newInfo.SameContent(&oldInfo) || (newInfo.Kind == CopyPath || newInfo.Kind == GlobPath) && new.Package != old.Package {
-						if old.Package > new.Package || old.Package == new.Package && old.Name > new.Name {
-							old, new = new, old
-						}
-						return fmt.Errorf("slices %s and %s conflict on %s", old, new, newPath)
-					}
-				} else {
-					if newInfo.Kind == GlobPath {
-						globs[newPath] = new
-					}
-					paths[newPath] = new
-				}
+// MaxDependencyDepth returns the length of the longest chain of essential
+// dependencies in the release, counted in slices, along with one such chain
+// starting from the dependent slice. A slice without essentials has depth 1.
+// The release must be free of essential loops, as ensured by ReadRelease.
+func (r *Release) MaxDependencyDepth() (int, []SliceKey) {
+	chains := make(map[SliceKey][]SliceKey)
+	var chain func(key SliceKey) []SliceKey
+	chain = func(key SliceKey) []SliceKey {
+		if c, ok := chains[key]; ok {
+			return c
+		}
+		slice := r.Packages[key.Package].Slices[key.Slice]
+		var longest []SliceKey
+		for _, req := range slice.Essential {
+			if c := chain(req); len(c) > len(longest) {
+				longest = c
 			}
 		}
+		c := append([]SliceKey{key}, longest...)
+		chains[key] = c
+		return c
+	}
+	var longest []SliceKey
+	for _, slice := range r.sortedSlices() {
+		if c := chain(SliceKey{slice.Package, slice.Name}); len(c) > len(longest) {
+			longest = c
+		}
 	}
+	return len(longest), longest
+}
 
-	// Check for cycles.
-	_, err := order(r.Packages, keys)
-	if err != nil {
-		return err
+// DuplicateSlices returns groups of two or more slices that declare exactly
+// the same contents, regardless of their essentials. Slices with no contents
+// are not considered. This is advisory only, as such slices are valid.
+func (r *Release) DuplicateSlices() [][]SliceKey {
+	var groups [][]*Slice
+	for _, slice := range r.sortedSlices() {
+		if len(slice.Contents) == 0 {
+			continue
+		}
+		found := false
+		for i, group := range groups {
+			if reflect.DeepEqual(group[0].Contents, slice.Contents) {
+				groups[i] = append(group, slice)
+				found = true
+				break
+			}
+		}
+		if !found {
+			groups = append(groups, []*Slice{slice})
+		}
+	}
+	var result [][]SliceKey
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		keys := make([]SliceKey, len(group))
+		for i, slice := range group {
+			keys[i] = SliceKey{slice.Package, slice.Name}
+		}
+		result = append(result, keys)
 	}
+	return result
+}
 
-	// Check for glob conflicts.
-	for newPath, new := range globs {
-		for oldPath, old := range paths {
-			if new.Package == old.Package {
-				continue
+// ShadowedPaths returns warnings for explicit paths that are matched by a
+// glob in the same slice and have no attributes to distinguish them from
+// it. Explicit paths take precedence over globs when extracting, so such
+// entries are redundant. This is advisory only, as they are still valid.
+func (r *Release) ShadowedPaths() []string {
+	var warnings []string
+	for _, slice := range r.sortedSlices() {
+		var globs, explicit []string
+		for path, info := range slice.Contents {
+			switch {
+			case info.Kind == GlobPath:
+				globs = append(globs, path)
+			case info.Kind == CopyPath && info.Info == "" && info.Mode == 0 && !info.Mutable:
+				explicit = append(explicit, path)
 			}
-			if strdist.GlobPath(newPath, oldPath) {
-				if old.Package > new.Package || old.Package == new.Package && old.Name > new.Name {
-					old, oldPath, new, newPath = new, newPath, old, oldPath
+		}
+		sort.Strings(globs)
+		sort.Strings(explicit)
+		for _, path := range explicit {
+			info := slice.Contents[path]
+			for _, glob := range globs {
+				globInfo := slice.Contents[glob]
+				if info.Until == globInfo.Until && reflect.DeepEqual(info.Arch, globInfo.Arch) && strdist.GlobPath(glob, path) {
+					warnings = append(warnings, fmt.Sprintf("slice %s path %s is redundant with %s", slice, path, glob))
+					break
 				}
-				return fmt.Errorf("slices %s and %s conflict on %s and %s", old, new, oldPath, newPath)
 			}
 		}
-		paths[newPath] = new
 	}
-
-	return nil
+	return warnings
 }
 
-func order(pkgs map[string]*Package, keys []SliceKey) ([]SliceKey, error) {
-
-	// Preprocess the list to improve error messages.
-	for _, key := range keys {
-		if pkg, ok := pkgs[key.Package]; !ok {
-			return nil, fmt.Errorf("slices of package %q not found", key.Package)
-		} else if _, ok := pkg.Slices[key.Slice]; !ok {
-			return nil, fmt.Errorf("slice %s not found", key)
+// SlicesWithPath returns the keys of all slices in the release declaring
+// the provided path, either explicitly or via a wildcard matching it,
+// sorted by package and slice name.
+func (r *Release) SlicesWithPath(path string) []SliceKey {
+	var keys []SliceKey
+	for _, slice := range r.sortedSlices() {
+		for contPath, info := range slice.Contents {
+			if contPath == path || info.Kind == GlobPath && strdist.GlobPath(contPath, path) {
+				keys = append(keys, SliceKey{slice.Package, slice.Name})
+				break
+			}
 		}
 	}
+	return keys
+}
 
-	// Collect all relevant package slices.
-	successors := map[string][]string{}
-	pending := append([]SliceKey(nil), keys...)
-
-	seen := make(map[SliceKey]bool)
-	for i := 0; i < len(pending); i++ {
-		key := pending[i]
-		if seen[key] {
-			continue
-		}
-		seen[key] = true
-		pkg := pkgs[key.Package]
-		slice := pkg.Slices[key.Slice]
-		fqslice := slice.String()
-		predecessors := successors[fqslice]
-		for _, req := range slice.Essential {
-			fqreq := req.String()
-			if reqpkg, ok := pkgs[req.Package]; !ok || reqpkg.Slices[req.Slice] == nil {
-				return nil, fmt.Errorf("%s requires %s, but slice is missing", fqslice, fqreq)
+// CanonicalizeGlobs returns the provided content paths without the ones
+// that are fully covered by another path in the list, such as duplicates,
+// paths matched by a wildcard, and wildcards under a broader "/**" path.
+// The remaining paths keep their original order.
+func CanonicalizeGlobs(globs []string) []string {
+	var result []string
+	for j, b := range globs {
+		subsumed := false
+		for i, a := range globs {
+			if i != j && (a != b || i < j) && globSubsumes(a, b) {
+				subsumed = true
+				break
 			}
-			predecessors = append(predecessors, fqreq)
 		}
-		successors[fqslice] = predecessors
-		pending = append(pending, slice.Essential...)
-	}
-
-	// Sort them up.
-	var order []SliceKey
-	for _, names := range tarjanSort(successors) {
-		if len(names) > 1 {
-			return nil, fmt.Errorf("essential loop detected: %s", strings.Join(names, ", "))
+		if !subsumed {
+			result = append(result, b)
 		}
-		name := names[0]
-		dot := strings.IndexByte(name, '_')
-		order = append(order, SliceKey{name[:dot], name[dot+1:]})
 	}
+	return result
+}
 
-	return order, nil
+// globSubsumes returns whether every path matched by b is also matched
+// by a. It may return false for some cases where that's the case.
+func globSubsumes(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if !strings.ContainsAny(b, "*?") {
+		return strdist.GlobPath(a, b)
+	}
+	prefix := strings.TrimSuffix(a, "**")
+	return prefix != a && !strings.ContainsAny(prefix, "*?") && strings.HasPrefix(b, prefix)
 }
 
-var fnameExp = regexp.MustCompile(`^([a-z0-9](?:-?[.a-z0-9+]){2,})\.yaml$`)
-var snameExp = regexp.MustCompile(`^([a-z](?:-?[a-z0-9]){2,})$`)
-var knameExp = regexp.MustCompile(`^([a-z0-9](?:-?[.a-z0-9+]){2,})_([a-z](?:-?[a-z0-9]){2,})$`)
+var binDirs = map[string]bool{
+	"/bin":            true,
+	"/sbin":           true,
+	"/usr/bin":        true,
+	"/usr/sbin":       true,
+	"/usr/local/bin":  true,
+	"/usr/local/sbin": true,
+}
 
-func ParseSliceKey(sliceKey string) (SliceKey, error) {
-	match := knameExp.FindStringSubmatch(sliceKey)
-	if match == nil {
-		return SliceKey{}, fmt.Errorf("invalid slice reference: %q", sliceKey)
+// NonExecutableBins returns warnings for files placed directly in a bin
+// directory with a mode lacking all executable bits, either declared or
+// the default mode for text content. Copies without a declared mode keep
+// the mode from the package and are not reported. This is advisory only.
+func (r *Release) NonExecutableBins() []string {
+	var warnings []string
+	for _, slice := range r.sortedSlices() {
+		paths := make([]string, 0, len(slice.Contents))
+		for path := range slice.Contents {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			info := slice.Contents[path]
+			if !binDirs[filepathDir(path)] {
+				continue
+			}
+			mode := info.Mode
+			switch info.Kind {
+			case CopyPath:
+				if mode == 0 {
+					continue
+				}
+			case TextPath:
+				if mode == 0 {
+					mode = 0644
+				}
+			default:
+				continue
+			}
+			if mode&0111 == 0 {
+				warnings = append(warnings, fmt.Sprintf("slice %s path %s is in a bin directory but has mode %04o", slice, path, mode))
+			}
+		}
 	}
-	return SliceKey{match[1], match[2]}, nil
+	return warnings
 }
 
-func readRelease(baseDir string) (*Release, error) {
-	baseDir = filepath.Clean(baseDir)
-	filePath := filepath.Join(baseDir, "chisel.yaml")
-	data, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("cannot read release definition: %s", err)
+func filepathDir(p string) string {
+	if strings.HasSuffix(p, "/") {
+		return ""
 	}
-	release, err := parseRelease(baseDir, filePath, data)
-	if err != nil {
-		return nil, err
+	return path.Dir(p)
+}
+
+// PackageDependencies returns, for every package with slices requiring
+// slices from other packages, the sorted names of those other packages.
+func (r *Release) PackageDependencies() map[string][]string {
+	deps := make(map[string][]string)
+	seen := make(map[[2]string]bool)
+	for _, slice := range r.sortedSlices() {
+		for _, req := range slice.Essential {
+			edge := [2]string{slice.Package, req.Package}
+			if req.Package == slice.Package || seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			deps[slice.Package] = append(deps[slice.Package], req.Package)
+		}
 	}
-	err = readSlices(release, baseDir, filepath.Join(baseDir, "slices"))
-	if err != nil {
-		return nil, err
+	for _, names := range deps {
+		sort.Strings(names)
 	}
-	return release, err
+	return deps
 }
 
-func readSlices(release *Release, baseDir, dirName string) error {
-	finfos, err := ioutil.ReadDir(dirName)
-	if err != nil {
-		return fmt.Errorf("cannot read %s%c directory", stripBase(baseDir, dirName), filepath.Separator)
-	}
+// PathRef references a path declared by a slice.
+type PathRef struct {
+	Slice SliceKey
+	Path  string
+	Mode  uint
+}
 
-	for _, finfo := range finfos {
-		if finfo.IsDir() {
-			err := readSlices(release, baseDir, filepath.Join(dirName, finfo.Name()))
-			if err != nil {
-				return err
+// AllDirs returns all directories made by the slices in the release,
+// ordered by package, slice name, and path. Directories declared without
+// a mode have the default mode 0755.
+func (r *Release) AllDirs() []PathRef {
+	var refs []PathRef
+	for _, slice := range r.sortedSlices() {
+		paths := make([]string, 0, len(slice.Contents))
+		for path, info := range slice.Contents {
+			if info.Kind == DirPath {
+				paths = append(paths, path)
 			}
-			continue
 		}
-		if finfo.IsDir() || !strings.HasSuffix(finfo.Name(), ".yaml") {
-			continue
-		}
-		match := fnameExp.FindStringSubmatch(finfo.Name())
-		if match == nil {
-			return fmt.Errorf("invalid slice definition filename: %q\")", finfo.Name())
+		sort.Strings(paths)
+		for _, path := range paths {
+			mode := slice.Contents[path].Mode
+			if mode == 0 {
+				mode = 0755
+			}
+			refs = append(refs, PathRef{
+				Slice: SliceKey{slice.Package, slice.Name},
+				Path:  path,
+				Mode:  mode,
+			})
 		}
+	}
+	return refs
+}
 
-		pkgName := match[1]
-		pkgPath := filepath.Join(dirName, finfo.Name())
-		if pkg, ok := release.Packages[pkgName]; ok {
-			return fmt.Errorf("package %q slices defined more than once: %s and %s\")", pkgName, pkg.Path, pkgPath)
-		}
-		data, err := ioutil.ReadFile(pkgPath)
-		if err != nil {
-			// Errors from package os generally include the path.
-			return fmt.Errorf("cannot read slice definition file: %v", err)
-		}
+// TextRef references a text path declared by a slice.
+type TextRef struct {
+	Slice SliceKey
+	Path  string
+	// Size holds the length of the text in bytes.
+	Size int
+}
 
-		pkg, err := parsePackage(baseDir, pkgName, stripBase(baseDir, pkgPath), data)
-		if err != nil {
-			return err
+// TextContents returns all text paths declared in the release, ordered by
+// package, slice name, and path.
+func (r *Release) TextContents() []TextRef {
+	var refs []TextRef
+	for _, slice := range r.sortedSlices() {
+		paths := make([]string, 0, len(slice.Contents))
+		for path, info := range slice.Contents {
+			if info.Kind == TextPath {
+				paths = append(paths, path)
+			}
 		}
-		if pkg.Archive == "" {
-			pkg.Archive = release.DefaultArchive
+		sort.Strings(paths)
+		for _, path := range paths {
+			refs = append(refs, TextRef{
+				Slice: SliceKey{slice.Package, slice.Name},
+				Path:  path,
+				Size:  len(slice.Contents[path].Info),
+			})
 		}
-
-		release.Packages[pkg.Name] = pkg
 	}
-	return nil
+	return refs
 }
 
-type yamlRelease struct {
-	Format   string                 `yaml:"format"`
-	Archives map[string]yamlArchive `yaml:"archives`
+// ReadOptions holds optional settings for ReadReleaseWithOptions.
+type ReadOptions struct {
+	// Arch is the architecture the release is read for. Slice definitions
+	// named as <package>.<arch>.yaml are merged into the definitions for
+	// the package only when their architecture matches this one, and
+	// are otherwise just validated.
+	Arch string
+
+	// MaxTextLines limits the number of lines in text content.
+	// Zero means no limit.
+	MaxTextLines int
+
+	// NoTrailingSpace rejects text content with lines ending in spaces
+	// or tabs.
+	NoTrailingSpace bool
+
+	// MaxContents limits the number of content entries in each slice,
+	// with a wildcard path counting as a single entry. Zero means no limit.
+	MaxContents int
+
+	// CollectErrors makes problems found in the slice definition files
+	// and when validating the release be collected rather than returned
+	// as soon as the first one is found. They are then reported together,
+	// one per line and sorted, with problems in individual files prefixed
+	// by the file path. Files that cannot be read are left out when
+	// validating the release, which may cause further problems.
+	CollectErrors bool
+
+	// CleanSymlinks normalizes symlink targets that are not clean paths,
+	// such as "/a/./b", instead of rejecting them.
+	CleanSymlinks bool
+
+	// WarnEndOfLife adds a warning to the release for every Ubuntu archive
+	// with a version that is known to have reached its end of life.
+	WarnEndOfLife bool
+
+	// Provider, if set, lists the files shipped by packages. It enables
+	// the checks that depend on package contents, such as the package
+	// max-total-files limit.
+	Provider FileLister
+
+	// MaxTotalBytes and MaxFiles limit the total size and number of the
+	// files read for the release, such as when reading it from an
+	// untrusted archive. Zero means no limit.
+	MaxTotalBytes int64
+	MaxFiles      int
 }
 
-const yamlReleaseFormat = "chisel-v1"
-
-type yamlArchive struct {
-	Version    string   `yaml:"version"`
-	Suites     []string `yaml:"suites"`
-	Components []string `yaml:"components"`
-	Default    bool     `yaml:"default"`
+func ReadRelease(dir string) (*Release, error) {
+	return ReadReleaseWithOptions(dir, nil)
 }
 
-type yamlPackage struct {
-	Name    string               `yaml:"package"`
-	Archive string               `yaml:"archive"`
-	Slices  map[string]yamlSlice `yaml:"slices"`
+func ReadReleaseWithOptions(dir string, options *ReadOptions) (*Release, error) {
+	logDir := dir
+	if strings.Contains(dir, "/.cache/") {
+		logDir = filepath.Base(dir)
+	}
+	logf("Processing %s release...", logDir)
+
+	release, err := readReleaseFS(os.DirFS(dir), options)
+	if err != nil {
+		return nil, err
+	}
+	release.Path = filepath.Clean(dir)
+	return release, nil
 }
 
-type yamlPath struct {
-	Dir     bool    `yaml:"make"`
-	Mode    uint    `yaml:"mode"`
-	Copy    string  `yaml:"copy"`
-	Text    *string `yaml:"text"`
-	Symlink string  `yaml:"symlink"`
-	Mutable bool    `yaml:"mutable"`
+// ReadReleaseFS reads the release with chisel.yaml and the slices
+// directory at the root of fsys, such as a release embedded in the
+// program or extracted from an archive. The Path of the returned
+// release is empty, as the release has no location on disk.
+func ReadReleaseFS(fsys fs.FS) (*Release, error) {
+	return ReadReleaseFSWithOptions(fsys, nil)
+}
 
-	Until PathUntil `yaml:"until"`
-	Arch  yamlArch  `yaml:"arch"`
+func ReadReleaseFSWithOptions(fsys fs.FS, options *ReadOptions) (*Release, error) {
+	logf("Processing release...")
+	return readReleaseFS(fsys, options)
 }
 
-// SameContent returns whether the path has the same content properties as some
-// other path. In other words, the resulting file/dir entry is the same. The
-// Mutable flag must also match, as that's a common agreement that the actual
-// content is not well defined upfront.
-func (yp *yamlPath) SameContent(other *yamlPath) bool {
-	return (yp.Dir == other.Dir &&
-		yp.Mode == other.Mode &&
-		yp.Copy == other.Copy &&
-		yp.Text == other.Text &&
+func readReleaseFS(fsys fs.FS, options *ReadOptions) (*Release, error) {
+	if options == nil {
+		options = &ReadOptions{}
+	}
+
+	if options.MaxTotalBytes > 0 || options.MaxFiles > 0 {
+		fsys = &limitedFS{
+			FS:       fsys,
+			maxBytes: options.MaxTotalBytes,
+			maxFiles: options.MaxFiles,
+		}
+	}
+	var problems []string
+	report := func(filePath string, err error) error {
+		if !options.CollectErrors {
+			return err
+		}
+		msg := err.Error()
+		if filePath != "" && !strings.HasPrefix(msg, filePath+": ") {
+			msg = filePath + ": " + msg
+		}
+		problems = append(problems, msg)
+		return nil
+	}
+	reportRelease := func(err error) error {
+		return report("", err)
+	}
+
+	release, err := readRelease(fsys, options, report)
+	if err == nil {
+		err = release.validate(reportRelease)
+	}
+	if err == nil {
+		err = release.check(options, reportRelease)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		unique := problems[:1]
+		for _, msg := range problems[1:] {
+			if msg != unique[len(unique)-1] {
+				unique = append(unique, msg)
+			}
+		}
+		return nil, errors.New(strings.Join(unique, "\n"))
+	}
+	return release, nil
+}
+
+// check performs the optional checks enabled in options.
+func (r *Release) check(options *ReadOptions, report func(err error) error) error {
+	if options.WarnEndOfLife {
+		for _, archive := range sortedArchives(r.Archives) {
+			if archive.Distribution == "ubuntu" && ubuntuEndOfLife[archive.Version] {
+				warning := fmt.Sprintf("archive %q uses end-of-life Ubuntu version %s", archive.Name, archive.Version)
+				logf("Warning: %s", warning)
+				r.Warnings = append(r.Warnings, warning)
+			}
+		}
+	}
+	if options.Provider != nil {
+		pkgNames := make([]string, 0, len(r.Packages))
+		for pkgName := range r.Packages {
+			pkgNames = append(pkgNames, pkgName)
+		}
+		sort.Strings(pkgNames)
+		for _, pkgName := range pkgNames {
+			err := r.Packages[pkgName].CheckTotalFiles(options.Provider)
+			if err != nil {
+				if err = report(err); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, slice := range r.sortedSlices() {
+		if options.MaxContents > 0 && len(slice.Contents) > options.MaxContents {
+			err := report(fmt.Errorf("slice %s has %d content entries, more than the maximum of %d",
+				slice, len(slice.Contents), options.MaxContents))
+			if err != nil {
+				return err
+			}
+		}
+		paths := make([]string, 0, len(slice.Contents))
+		for path := range slice.Contents {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			info := slice.Contents[path]
+			if info.Kind != TextPath {
+				continue
+			}
+			if lines := countLines(info.Info); options.MaxTextLines > 0 && lines > options.MaxTextLines {
+				err := report(fmt.Errorf("slice %s path %s has %d lines of text, more than the maximum of %d",
+					slice, path, lines, options.MaxTextLines))
+				if err != nil {
+					return err
+				}
+			}
+			if options.NoTrailingSpace {
+				for i, line := range strings.Split(info.Info, "\n") {
+					if strings.TrimRight(line, " \t") != line {
+						err := report(fmt.Errorf("slice %s path %s has trailing whitespace on line %d", slice, path, i+1))
+						if err != nil {
+							return err
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// countLines returns the number of lines in text, including a last
+// line not terminated by a newline.
+func countLines(text string) int {
+	lines := strings.Count(text, "\n")
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		lines++
+	}
+	return lines
+}
+
+// Validate checks the release for consistency, returning the same errors
+// that ReadRelease would report for the equivalent slice definitions.
+// It allows releases built in memory to be checked before selecting
+// slices from them.
+func (r *Release) Validate() error {
+	return r.validate(func(err error) error { return err })
+}
+
+// validate checks the release for consistency, passing each problem found
+// to report. Checking stops when report returns an error, which is then
+// returned.
+func (r *Release) validate(report func(err error) error) error {
+	if r.DefaultArchive != "" && r.Archives[r.DefaultArchive] == nil {
+		err := report(fmt.Errorf("default archive %q is not defined", r.DefaultArchive))
+		if err != nil {
+			return err
+		}
+	}
+
+	keys := []SliceKey(nil)
+	slices := r.sortedSlices()
+	for _, slice := range slices {
+		keys = append(keys, SliceKey{slice.Package, slice.Name})
+	}
+
+	// Check content paths and their details.
+	for _, slice := range slices {
+		paths := make([]string, 0, len(slice.Contents))
+		for path := range slice.Contents {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			info := slice.Contents[path]
+			err := checkPathInfo(slice.Package, slice.Name, path, &info)
+			if err != nil {
+				if err = report(err); err != nil {
+					return err
+				}
+				continue
+			}
+			// Symlinks are reported by checkPaths, which also handles
+			// them across slices.
+			if strings.HasSuffix(path, "/") && path != "/" {
+				other := path[:len(path)-1]
+				if info, ok := slice.Contents[other]; ok && info.Kind != SymlinkPath {
+					err = report(fmt.Errorf("slice %s declares both %s and %s", slice, other, path))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	// Check for info conflicts and prepare for following checks.
+	paths, err := r.checkPaths(slices)
+	if err != nil {
+		if err = report(err); err != nil {
+			return err
+		}
+	}
+	globs := make(map[string]*Slice)
+	for path, slice := range paths {
+		if slice.Contents[path].Kind == GlobPath {
+			globs[path] = slice
+		}
+	}
+
+	// Check for cycles.
+	_, err = order(r.Packages, keys, nil)
+	if err != nil {
+		if err = report(err); err != nil {
+			return err
+		}
+	}
+
+	// Check for essentials obtained from incompatible archives.
+	for _, slice := range slices {
+		pkg := r.Packages[slice.Package]
+		for _, req := range slice.Essential {
+			reqPkg := r.Packages[req.Package]
+			if reqPkg == nil || !pkg.Pinned && !reqPkg.Pinned {
+				continue
+			}
+			archive, reqArchive := r.Archives[pkg.Archive], r.Archives[reqPkg.Archive]
+			if archive == nil || reqArchive == nil {
+				continue
+			}
+			if archive.Distribution != reqArchive.Distribution || archive.Version != reqArchive.Version {
+				err = report(fmt.Errorf("slice %s from archive %q (%s %s) requires %s from incompatible archive %q (%s %s)",
+					slice, archive.Name, archive.Distribution, archive.Version,
+					req, reqArchive.Name, reqArchive.Distribution, reqArchive.Version))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Check mutation scripts.
+	for _, slice := range slices {
+		err = r.checkMutate(slice)
+		if err != nil {
+			if err = report(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Check for glob conflicts. Overlapping globs from different packages
+	// only conflict on the files shipped by both, which are not known here.
+	for newPath, new := range globs {
+		for oldPath, old := range paths {
+			if new.Package == old.Package || old.Contents[oldPath].Kind == GlobPath {
+				continue
+			}
+			if winner := r.replacer(oldPath); winner != "" && r.replacer(newPath) == winner && (winner == old.Package || winner == new.Package) {
+				continue
+			}
+			if disjointArch(new.Contents[newPath].Arch, old.Contents[oldPath].Arch) {
+				continue
+			}
+			if strdist.GlobPath(newPath, oldPath) {
+				first, firstPath, second, secondPath := old, oldPath, new, newPath
+				if first.Package > second.Package || first.Package == second.Package && first.Name > second.Name {
+					first, firstPath, second, secondPath = second, secondPath, first, firstPath
+				}
+				err = report(fmt.Errorf("slices %s and %s conflict on %s and %s", first, second, firstPath, secondPath))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		paths[newPath] = new
+	}
+
+	return nil
+}
+
+// checkPaths checks the contents of the provided slices for conflicts, and
+// returns the first slice declaring each of the paths. Paths taken over
+// by a package via the release replaces map are only checked among the
+// slices of that package, when it declares them.
+func (r *Release) checkPaths(slices []*Slice) (map[string]*Slice, error) {
+	taken := make(map[string]string)
+	for _, slice := range slices {
+		for path := range slice.Contents {
+			if winner := r.replacer(path); winner == slice.Package {
+				taken[path] = winner
+			}
+		}
+	}
+
+	paths := make(map[string]*Slice)
+	for _, new := range slices {
+		for newPath, newInfo := range new.Contents {
+			if winner, ok := taken[newPath]; ok && winner != new.Package {
+				continue
+			}
+			if old, ok := paths[newPath]; ok {
+				oldInfo := old.Contents[newPath]
+				if conflicts(old, &oldInfo, new, &newInfo) {
+					if old.Package > new.Package || old.Package == new.Package && old.Name > new.Name {
+						old, oldInfo, new, newInfo = new, newInfo, old, oldInfo
+					}
+					if oldInfo.UID != newInfo.UID || oldInfo.GID != newInfo.GID {
+						return nil, fmt.Errorf("slices %s and %s conflict on %s: owner %d:%d != %d:%d",
+							old, new, newPath, oldInfo.UID, oldInfo.GID, newInfo.UID, newInfo.GID)
+					}
+					return nil, fmt.Errorf("slices %s and %s conflict on %s", old, new, newPath)
+				}
+				continue
+			}
+			paths[newPath] = new
+		}
+	}
+
+	// A symlink cannot also be a concrete directory.
+	for dirPath, dirSlice := range paths {
+		if !strings.HasSuffix(dirPath, "/") || dirPath == "/" {
+			continue
+		}
+		linkPath := dirPath[:len(dirPath)-1]
+		linkSlice, ok := paths[linkPath]
+		if !ok || linkSlice.Contents[linkPath].Kind != SymlinkPath {
+			continue
+		}
+		if linkSlice == dirSlice {
+			return nil, fmt.Errorf("slice %s declares %s both as a symlink and as %s", linkSlice, linkPath, dirPath)
+		}
+		return nil, fmt.Errorf("slices %s and %s conflict on symlink %s and %s", linkSlice, dirSlice, linkPath, dirPath)
+	}
+
+	// A regular file cannot have other content within it.
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+	for _, innerPath := range sorted {
+		parent := strings.TrimSuffix(innerPath, "/")
+		if parent == innerPath {
+			parent = path.Dir(parent)
+		}
+		for ; parent != "/"; parent = path.Dir(parent) {
+			fileSlice, ok := paths[parent]
+			if !ok {
+				continue
+			}
+			if kind := fileSlice.Contents[parent].Kind; kind != CopyPath && kind != TextPath {
+				continue
+			}
+			innerSlice := paths[innerPath]
+			if fileSlice == innerSlice {
+				return nil, fmt.Errorf("slice %s declares file %s and %s within it", fileSlice, parent, innerPath)
+			}
+			return nil, fmt.Errorf("slices %s and %s conflict on file %s and %s within it", fileSlice, innerSlice, parent, innerPath)
+		}
+	}
+	return paths, nil
+}
+
+// replacer returns the package that takes over the provided path according
+// to the longest matching prefix in the release replaces map, or an empty
+// string if there's no such package. Prefixes match whole path components,
+// so /usr/lib/foo covers /usr/lib/foo/bar but not /usr/lib/foobar.
+func (r *Release) replacer(path string) string {
+	var prefix, winner string
+	for p, pkg := range r.Replaces {
+		matches := path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/")
+		if matches && len(p) > len(prefix) {
+			prefix, winner = p, pkg
+		}
+	}
+	return winner
+}
+
+// essentialGraph maps the names of the provided slices to the names of
+// the slices they require, as essentials after substitution.
+func essentialGraph(pkgs map[string]*Package, keys []SliceKey, subst map[SliceKey]SliceKey) map[string][]string {
+	successors := map[string][]string{}
+	for _, key := range keys {
+		slice := pkgs[key.Package].Slices[key.Slice]
+		var predecessors []string
+		for _, req := range slice.Essential {
+			predecessors = append(predecessors, substitute(subst, req).String())
+		}
+		successors[slice.String()] = predecessors
+	}
+	return successors
+}
+
+// GraphDOT returns the essentials of all slices in the release as a
+// Graphviz digraph, with an edge from each slice to every slice it
+// requires. Nodes and edges are sorted by name.
+func (r *Release) GraphDOT() string {
+	var keys []SliceKey
+	for _, slice := range r.sortedSlices() {
+		keys = append(keys, SliceKey{slice.Package, slice.Name})
+	}
+	successors := essentialGraph(r.Packages, keys, nil)
+	names := make([]string, 0, len(successors))
+	for name := range successors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf strings.Builder
+	buf.WriteString("digraph slices {\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "\t%q;\n", name)
+	}
+	for _, name := range names {
+		reqs := append([]string(nil), successors[name]...)
+		sort.Strings(reqs)
+		for _, req := range reqs {
+			fmt.Fprintf(&buf, "\t%q -> %q;\n", name, req)
+		}
+	}
+	buf.WriteString("}\n")
+	return buf.String()
+}
+
+func order(pkgs map[string]*Package, keys []SliceKey, subst map[SliceKey]SliceKey) ([]SliceKey, error) {
+
+	// Collect all relevant package slices.
+	keys, err := closure(pkgs, keys, subst)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for loops.
+	for _, names := range tarjanSort(essentialGraph(pkgs, keys, subst)) {
+		if len(names) > 1 {
+			return nil, fmt.Errorf("essential loop detected: %s", strings.Join(names, ", "))
+		}
+	}
+
+	// Sort them up, with essentials first and ties broken by name.
+	pending := make(map[SliceKey]int)
+	dependents := make(map[SliceKey][]SliceKey)
+	for _, key := range keys {
+		seen := make(map[SliceKey]bool)
+		for _, req := range pkgs[key.Package].Slices[key.Slice].Essential {
+			req = substitute(subst, req)
+			if req == key || seen[req] {
+				continue
+			}
+			seen[req] = true
+			pending[key]++
+			dependents[req] = append(dependents[req], key)
+		}
+	}
+	var ready []SliceKey
+	for _, key := range keys {
+		if pending[key] == 0 {
+			ready = append(ready, key)
+		}
+	}
+	order := make([]SliceKey, 0, len(keys))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool {
+			return ready[i].Package < ready[j].Package ||
+				ready[i].Package == ready[j].Package && ready[i].Slice < ready[j].Slice
+		})
+		key := ready[0]
+		ready = ready[1:]
+		order = append(order, key)
+		for _, dependent := range dependents[key] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	return order, nil
+}
+
+// closure returns the provided keys and all the slices they transitively
+// require, in the order they were first reached and without duplicates.
+// Keys found in subst are replaced by their substitutes as they are reached.
+func closure(pkgs map[string]*Package, keys []SliceKey, subst map[SliceKey]SliceKey) ([]SliceKey, error) {
+
+	// Preprocess the list to improve error messages.
+	for _, key := range keys {
+		if pkg, ok := pkgs[key.Package]; !ok {
+			return nil, fmt.Errorf("slices of package %q not found", key.Package)
+		} else if _, ok := pkg.Slices[key.Slice]; !ok {
+			return nil, fmt.Errorf("slice %s not found", key)
+		}
+	}
+
+	var result []SliceKey
+	pending := append([]SliceKey(nil), keys...)
+	seen := make(map[SliceKey]bool)
+	for i := 0; i < len(pending); i++ {
+		key := substitute(subst, pending[i])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, key)
+		slice := pkgs[key.Package].Slices[key.Slice]
+		for _, req := range slice.Essential {
+			if reqpkg, ok := pkgs[req.Package]; !ok || reqpkg.Slices[req.Slice] == nil {
+				return nil, fmt.Errorf("%s requires %s, but slice is missing", slice, req)
+			}
+		}
+		pending = append(pending, slice.Essential...)
+	}
+	return result, nil
+}
+
+func substitute(subst map[SliceKey]SliceKey, key SliceKey) SliceKey {
+	if other, ok := subst[key]; ok {
+		return other
+	}
+	return key
+}
+
+// ClosureSize returns the number of slices in the transitive essential
+// closure of the provided keys, including the keys themselves. It's a
+// cheaper alternative to Select when the details are not needed, as
+// slices are neither ordered nor checked for conflicts.
+func (r *Release) ClosureSize(keys []SliceKey) (int, error) {
+	keys, err := closure(r.Packages, keys, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// ReachableFrom returns the root slice and all the slices it transitively
+// requires, ordered by package and slice name.
+func (r *Release) ReachableFrom(root SliceKey) ([]SliceKey, error) {
+	keys, err := closure(r.Packages, []SliceKey{root}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NormalizeSliceKeys(keys), nil
+}
+
+// UniqueClosure returns the slice and all the slices it transitively
+// requires, except for the ones also in the closure of the others keys,
+// ordered by package and slice name.
+func (r *Release) UniqueClosure(key SliceKey, others []SliceKey) ([]SliceKey, error) {
+	keys, err := closure(r.Packages, []SliceKey{key}, nil)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := closure(r.Packages, others, nil)
+	if err != nil {
+		return nil, err
+	}
+	excluded := make(map[SliceKey]bool, len(shared))
+	for _, other := range shared {
+		excluded[other] = true
+	}
+	var unique []SliceKey
+	for _, key := range keys {
+		if !excluded[key] {
+			unique = append(unique, key)
+		}
+	}
+	return NormalizeSliceKeys(unique), nil
+}
+
+var fnameExp = regexp.MustCompile(`^([a-z0-9](?:-?[.a-z0-9+]){2,})\.yaml$`)
+var snameExp = regexp.MustCompile(`^([a-z](?:-?[a-z0-9]){2,})$`)
+var knameExp = regexp.MustCompile(`^([a-z0-9](?:-?[.a-z0-9+]){2,})_([a-z](?:-?[a-z0-9]){2,})$`)
+var wnameExp = regexp.MustCompile(`^([a-z0-9](?:-?[.a-z0-9+]){2,})_\*$`)
+
+func ParseSliceKey(sliceKey string) (SliceKey, error) {
+	match := knameExp.FindStringSubmatch(sliceKey)
+	if match == nil {
+		return SliceKey{}, fmt.Errorf("invalid slice reference: %q", sliceKey)
+	}
+	return SliceKey{match[1], match[2]}, nil
+}
+
+// NormalizeSliceKeys returns the provided keys sorted by package and
+// slice name, and without duplicates.
+func NormalizeSliceKeys(keys []SliceKey) []SliceKey {
+	result := make([]SliceKey, 0, len(keys))
+	seen := make(map[SliceKey]bool, len(keys))
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			result = append(result, key)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Package != result[j].Package {
+			return result[i].Package < result[j].Package
+		}
+		return result[i].Slice < result[j].Slice
+	})
+	return result
+}
+
+// limitedFS enforces limits on the total size and number of the files
+// read via ReadFile.
+type limitedFS struct {
+	fs.FS
+	maxBytes int64
+	maxFiles int
+	bytes    int64
+	files    int
+}
+
+func (l *limitedFS) ReadFile(name string) ([]byte, error) {
+	l.files++
+	if l.maxFiles > 0 && l.files > l.maxFiles {
+		return nil, fmt.Errorf("release has more than %d files", l.maxFiles)
+	}
+	f, err := l.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if l.maxBytes > 0 {
+		// Read one byte past the limit to tell whether it was exceeded.
+		r = io.LimitReader(f, l.maxBytes-l.bytes+1)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l.bytes += int64(len(data))
+	if l.maxBytes > 0 && l.bytes > l.maxBytes {
+		return nil, fmt.Errorf("release has more than %d bytes", l.maxBytes)
+	}
+	return data, nil
+}
+
+// readRelease reads the release definitions from fsys. Problems that
+// do not prevent reading the rest of the release are passed to report,
+// with the path of the file they relate to when known, and reading stops
+// if it returns an error.
+func readRelease(fsys fs.FS, options *ReadOptions, report func(filePath string, err error) error) (*Release, error) {
+	filePath := "chisel.yaml"
+	data, err := fs.ReadFile(fsys, filePath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read release definition: %s", err)
+	}
+	release, err := parseRelease(filePath, data)
+	if err != nil {
+		return nil, err
+	}
+	reportRelease := func(err error) error {
+		return report("", err)
+	}
+	overrides := make(map[string]map[string]*Package)
+	err = readSlices(release, overrides, fsys, "slices", report)
+	if err != nil {
+		return nil, err
+	}
+	err = mergeOverrides(release, overrides, options.Arch, reportRelease)
+	if err != nil {
+		return nil, err
+	}
+	err = expandEssentials(release, reportRelease)
+	if err != nil {
+		return nil, err
+	}
+	for _, slice := range release.sortedSlices() {
+		for contPath, info := range slice.Contents {
+			if info.Kind != SymlinkPath || path.Clean(info.Info) == info.Info {
+				continue
+			}
+			if !options.CleanSymlinks {
+				err = reportRelease(fmt.Errorf("slice %s has non-clean symlink target for path %s: %s", slice, contPath, info.Info))
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			info.Info = path.Clean(info.Info)
+			slice.Contents[contPath] = info
+		}
+	}
+	prefixes := make([]string, 0, len(release.Replaces))
+	for prefix := range release.Replaces {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		pkgName := release.Replaces[prefix]
+		if _, ok := release.Packages[pkgName]; !ok {
+			err = report(filePath, fmt.Errorf("%s: replaces %s with undefined package %q", filePath, prefix, pkgName))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return release, nil
+}
+
+// readSlices reads the slice definitions under dirName into release, and
+// the architecture-specific ones into overrides. Problems with individual
+// files are passed to report, and reading stops if it returns an error.
+func readSlices(release *Release, overrides map[string]map[string]*Package, fsys fs.FS, dirName string, report func(filePath string, err error) error) error {
+	var pkgPaths []string
+	err := listSlices(fsys, dirName, &pkgPaths, report)
+	if err != nil {
+		return err
+	}
+
+	// Files included by other definitions are only read as part of them.
+	files := make(map[string][]byte)
+	included := make(map[string]bool)
+	for _, pkgPath := range pkgPaths {
+		data, err := fs.ReadFile(fsys, pkgPath)
+		if err != nil {
+			// Errors from package fs generally include the path.
+			err = report(pkgPath, fmt.Errorf("cannot read slice definition file: %v", err))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		files[pkgPath] = data
+		var yamlInc struct {
+			Include []string `yaml:"include"`
+		}
+		if yaml.Unmarshal(data, &yamlInc) == nil {
+			for _, inc := range yamlInc.Include {
+				if incPath, err := includePath(pkgPath, inc); err == nil {
+					included[incPath] = true
+				}
+			}
+		}
+	}
+	readInclude := func(incPath string) ([]byte, error) {
+		if data, ok := files[incPath]; ok {
+			return data, nil
+		}
+		return fs.ReadFile(fsys, incPath)
+	}
+
+	for _, pkgPath := range pkgPaths {
+		data, ok := files[pkgPath]
+		if !ok || included[pkgPath] {
+			continue
+		}
+		if !fnameExp.MatchString(path.Base(pkgPath)) {
+			err := report(pkgPath, fmt.Errorf("invalid slice definition filename: %q\")", path.Base(pkgPath)))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		pkgName := fnameExp.FindStringSubmatch(path.Base(pkgPath))[1]
+
+		// Definitions named as <package>.<arch>.yaml are specific to
+		// that architecture, and are merged later if relevant.
+		var pkgArch string
+		if dot := strings.LastIndexByte(pkgName, '.'); dot > 0 && deb.ValidateArch(pkgName[dot+1:]) == nil {
+			pkgName, pkgArch = pkgName[:dot], pkgName[dot+1:]
+			if pkg, ok := overrides[pkgName][pkgArch]; ok {
+				err := report(pkgPath, fmt.Errorf("package %q slices for %s defined more than once: %s and %s", pkgName, pkgArch, pkg.Path, pkgPath))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		} else if pkg, ok := release.Packages[pkgName]; ok {
+			err := report(pkgPath, fmt.Errorf("package %s defined in both %s and %s", pkgName, pkg.Path, pkgPath))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		pkg, err := parsePackage(pkgName, pkgPath, data, readInclude)
+		if err != nil {
+			err = report(pkgPath, err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if pkgArch != "" {
+			if pkg.Archive != "" {
+				err := report(pkg.Path, fmt.Errorf("%s: architecture-specific slice definitions cannot select an archive", pkg.Path))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if overrides[pkgName] == nil {
+				overrides[pkgName] = make(map[string]*Package)
+			}
+			overrides[pkgName][pkgArch] = pkg
+			continue
+		}
+		if pkg.Archive == "" {
+			pkg.Archive = release.DefaultArchive
+		} else if _, ok := release.Archives[pkg.Archive]; !ok {
+			err := report(pkg.Path, fmt.Errorf("%s: package refers to undefined archive %q", pkg.Path, pkg.Archive))
+			if err != nil {
+				return err
+			}
+			continue
+		} else {
+			pkg.Pinned = true
+		}
+
+		release.Packages[pkg.Name] = pkg
+	}
+	return nil
+}
+
+// listSlices appends to pkgPaths the paths of the slice definition files
+// found under dirName, in lexical order. Their names are only checked
+// once it is known which files are included by others.
+func listSlices(fsys fs.FS, dirName string, pkgPaths *[]string, report func(filePath string, err error) error) error {
+	finfos, err := fs.ReadDir(fsys, dirName)
+	if err != nil {
+		return fmt.Errorf("cannot read %s/ directory", dirName)
+	}
+	for _, finfo := range finfos {
+		if finfo.IsDir() {
+			err := listSlices(fsys, path.Join(dirName, finfo.Name()), pkgPaths, report)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(finfo.Name(), ".yaml") {
+			continue
+		}
+		*pkgPaths = append(*pkgPaths, path.Join(dirName, finfo.Name()))
+	}
+	return nil
+}
+
+// includePath returns the path of the file included by the slice
+// definitions in pkgPath, which is relative to the including file and
+// must be within the release directory.
+func includePath(pkgPath, inc string) (string, error) {
+	incPath := path.Join(path.Dir(pkgPath), inc)
+	if inc == "" || path.IsAbs(inc) || incPath == ".." || strings.HasPrefix(incPath, "../") {
+		return "", fmt.Errorf("%s: include %q escapes the release directory", pkgPath, inc)
+	}
+	return incPath, nil
+}
+
+// mergeOverrides merges the architecture-specific slice definitions
+// matching arch into the respective packages. Slices that are already
+// defined get the additional essentials and contents, and have their
+// mutation script replaced when one is provided.
+func mergeOverrides(release *Release, overrides map[string]map[string]*Package, arch string, report func(err error) error) error {
+	pkgNames := make([]string, 0, len(overrides))
+	for pkgName := range overrides {
+		pkgNames = append(pkgNames, pkgName)
+	}
+	sort.Strings(pkgNames)
+	for _, pkgName := range pkgNames {
+		archOverrides := overrides[pkgName]
+		pkg, ok := release.Packages[pkgName]
+		if !ok {
+			var paths []string
+			for _, override := range archOverrides {
+				paths = append(paths, override.Path)
+			}
+			sort.Strings(paths)
+			err := report(fmt.Errorf("%s: package %q has no base slice definitions", paths[0], pkgName))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		override, ok := archOverrides[arch]
+		if !ok {
+			continue
+		}
+		for sliceName, newSlice := range override.Slices {
+			slice, ok := pkg.Slices[sliceName]
+			if !ok {
+				pkg.Slices[sliceName] = newSlice
+				continue
+			}
+			for _, key := range newSlice.Essential {
+				found := false
+				for _, old := range slice.Essential {
+					if old == key {
+						found = true
+						break
+					}
+				}
+				if !found {
+					slice.Essential = append(slice.Essential, key)
+				}
+			}
+			if len(newSlice.Contents) > 0 && slice.Contents == nil {
+				slice.Contents = make(map[string]PathInfo, len(newSlice.Contents))
+			}
+			for path, info := range newSlice.Contents {
+				slice.Contents[path] = info
+			}
+			if newSlice.Scripts.Mutate != "" {
+				slice.Scripts.Mutate = newSlice.Scripts.Mutate
+			}
+		}
+	}
+	return nil
+}
+
+type yamlRelease struct {
+	Format   string                 `yaml:"format"`
+	Archives map[string]yamlArchive `yaml:"archives"`
+	Replaces map[string]string      `yaml:"replaces"`
+}
+
+const yamlReleaseFormat = "chisel-v1"
+
+type yamlArchive struct {
+	Version      string   `yaml:"version"`
+	Suites       []string `yaml:"suites"`
+	Components   []string `yaml:"components"`
+	Default      bool     `yaml:"default"`
+	URL          string   `yaml:"url"`
+	Priority     int      `yaml:"priority"`
+	Distribution string   `yaml:"distribution"`
+}
+
+type yamlPackage struct {
+	Name          string               `yaml:"package"`
+	Archive       string               `yaml:"archive"`
+	MaxTotalFiles int                  `yaml:"max-total-files"`
+	Essential     []string             `yaml:"essential"`
+	Include       []string             `yaml:"include"`
+	Slices        map[string]yamlSlice `yaml:"slices"`
+}
+
+// yamlInclude holds slice definitions included by a package.
+type yamlInclude struct {
+	Slices map[string]yamlSlice `yaml:"slices"`
+}
+
+type yamlPath struct {
+	Dir     bool      `yaml:"make"`
+	Mode    yamlMode  `yaml:"mode"`
+	Copy    string    `yaml:"copy"`
+	Text    *yamlText `yaml:"text"`
+	Symlink string    `yaml:"symlink"`
+	Mutable bool      `yaml:"mutable"`
+
+	Hardlink string `yaml:"hardlink"`
+
+	// Relative allows the symlink target to be a relative path.
+	Relative bool `yaml:"relative"`
+
+	// SHA256 holds the expected digest of the text, in hex.
+	SHA256 string `yaml:"sha256"`
+
+	UID int `yaml:"uid"`
+	GID int `yaml:"gid"`
+
+	Until PathUntil `yaml:"until"`
+	Arch  yamlArch  `yaml:"arch"`
+}
+
+// SameContent returns whether the path has the same content properties as some
+// other path. In other words, the resulting file/dir entry is the same. The
+// Mutable flag must also match, as that's a common agreement that the actual
+// content is not well defined upfront.
+func (yp *yamlPath) SameContent(other *yamlPath) bool {
+	return (yp.Dir == other.Dir &&
+		yp.Mode == other.Mode &&
+		yp.Copy == other.Copy &&
+		yp.Text == other.Text &&
 		yp.Symlink == other.Symlink &&
+		yp.Hardlink == other.Hardlink &&
+		yp.Relative == other.Relative &&
+		yp.SHA256 == other.SHA256 &&
+		yp.UID == other.UID &&
+		yp.GID == other.GID &&
 		yp.Mutable == other.Mutable)
 }
 
-type yamlArch struct {
-	list []string
+// zeroPath is a path with no options, as only allowed for wildcards.
+var zeroPath yamlPath
+
+// yamlPositions locates the slices and their content paths in a package
+// definition, for reporting the origin of errors.
+type yamlPositions struct {
+	slices *yaml.Node
+}
+
+func newYamlPositions(data []byte) yamlPositions {
+	var doc yaml.Node
+	if yaml.Unmarshal(data, &doc) != nil || len(doc.Content) != 1 {
+		return yamlPositions{}
+	}
+	return yamlPositions{slices: mappingValue(doc.Content[0], "slices")}
+}
+
+// duplicateSlice returns the first slice name defined more than once,
+// which the YAML decoder would otherwise reject with a generic error.
+func (p yamlPositions) duplicateSlice() (string, bool) {
+	if p.slices == nil || p.slices.Kind != yaml.MappingNode {
+		return "", false
+	}
+	seen := make(map[string]bool)
+	for i := 0; i+1 < len(p.slices.Content); i += 2 {
+		name := p.slices.Content[i].Value
+		if seen[name] {
+			return name, true
+		}
+		seen[name] = true
+	}
+	return "", false
+}
+
+// content returns the line and column where the content path of the slice
+// is declared, or zeroes if unknown.
+func (p yamlPositions) content(sliceName, contPath string) (line, col int) {
+	if p.slices == nil {
+		return 0, 0
+	}
+	contents := mappingValue(mappingValue(p.slices, sliceName), "contents")
+	if contents == nil || contents.Kind != yaml.MappingNode {
+		return 0, 0
+	}
+	for i := 0; i+1 < len(contents.Content); i += 2 {
+		if key := contents.Content[i]; key.Value == contPath {
+			return key.Line, key.Column
+		}
+	}
+	return 0, 0
+}
+
+// yamlText holds either a plain text string or, when in the
+// {append: <text>} form, text to be appended to the same path.
+type yamlText struct {
+	text   string
+	append bool
+}
+
+func (yt *yamlText) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return value.Decode(&yt.text)
+	}
+	var m map[string]string
+	if value.Decode(&m) != nil {
+		return fmt.Errorf("cannot decode text")
+	}
+	text, ok := m["append"]
+	if !ok || len(m) != 1 {
+		return fmt.Errorf("text must be a string or an append mapping")
+	}
+	yt.text = text
+	yt.append = true
+	return nil
+}
+
+// yamlMode holds the mode of a content path as written, so that it can be
+// validated and resolved once the kind of the path is known.
+type yamlMode struct {
+	tag   string
+	value string
+}
+
+func (ym *yamlMode) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("mode must be a scalar")
+	}
+	ym.tag = value.ShortTag()
+	ym.value = value.Value
+	return nil
+}
+
+var octalModeExp = regexp.MustCompile("^(0o?)?[0-7]+$")
+
+// resolve returns the mode as an integer. Unquoted integers must be in
+// octal notation with a leading zero, as a bare decimal is ambiguous.
+// Quoted strings may hold octal digits or symbolic modes, such as
+// "u+rwx,go+rx", which are applied on top of base.
+func (ym *yamlMode) resolve(base uint) (uint, error) {
+	var mode uint64
+	var err error
+	switch {
+	case ym.tag == "" && ym.value == "":
+		return 0, nil
+	case ym.tag == "!!int":
+		if !strings.HasPrefix(ym.value, "0") || !octalModeExp.MatchString(ym.value) {
+			return 0, fmt.Errorf("mode must be quoted octal or symbolic")
+		}
+		mode, err = strconv.ParseUint(strings.TrimPrefix(ym.value, "0o"), 8, 32)
+	case ym.tag == "!!str" && octalModeExp.MatchString(ym.value):
+		mode, err = strconv.ParseUint(strings.TrimPrefix(ym.value, "0o"), 8, 32)
+	case ym.tag == "!!str":
+		return symbolicMode(ym.value, base)
+	default:
+		return 0, fmt.Errorf("mode must be quoted octal or symbolic")
+	}
+	if err != nil || mode > 07777 {
+		return 0, fmt.Errorf("invalid mode: %q", ym.value)
+	}
+	return uint(mode), nil
+}
+
+// symbolicMode applies the comma-separated clauses of a symbolic mode
+// in the chmod style, such as "u=rwx,g+s,o-w", on top of base.
+func symbolicMode(symbolic string, base uint) (uint, error) {
+	mode := base
+	for _, clause := range strings.Split(symbolic, ",") {
+		op := strings.IndexAny(clause, "+-=")
+		if op < 0 {
+			return 0, fmt.Errorf("invalid mode: %q", symbolic)
+		}
+		var who, perms uint
+		for _, c := range clause[:op] {
+			switch c {
+			case 'u':
+				who |= 04700
+			case 'g':
+				who |= 02070
+			case 'o':
+				who |= 01007
+			case 'a':
+				who |= 07777
+			default:
+				return 0, fmt.Errorf("invalid mode: %q", symbolic)
+			}
+		}
+		if who == 0 {
+			who = 07777
+		}
+		for _, c := range clause[op+1:] {
+			switch c {
+			case 'r':
+				perms |= 0444
+			case 'w':
+				perms |= 0222
+			case 'x':
+				perms |= 0111
+			case 's':
+				perms |= 06000
+			case 't':
+				perms |= 01000
+			default:
+				return 0, fmt.Errorf("invalid mode: %q", symbolic)
+			}
+		}
+		perms &= who
+		switch clause[op] {
+		case '+':
+			mode |= perms
+		case '-':
+			mode &^= perms
+		case '=':
+			mode = mode&^who | perms
+		}
+	}
+	return mode, nil
+}
+
+type yamlArch struct {
+	list []string
+}
+
+func (ya *yamlArch) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	var l []string
+	if value.Decode(&s) == nil {
+		ya.list = []string{s}
+	} else if value.Decode(&l) == nil {
+		ya.list = l
+	} else {
+		return fmt.Errorf("cannot decode arch")
+	}
+	// Validate arch correctness later for a better error message.
+	return nil
+}
+
+type yamlSlice struct {
+	Essential    []string             `yaml:"essential"`
+	Contents     map[string]*yamlPath `yaml:"contents"`
+	Mutate       string               `yaml:"mutate"`
+	Deprecated   *yamlDeprecated      `yaml:"deprecated"`
+	Experimental bool                 `yaml:"experimental"`
+}
+
+// yamlDeprecated holds either a plain deprecation message or, when in
+// the {since: <version>, message: <text>} form, the message together
+// with the version in which the slice was deprecated.
+type yamlDeprecated struct {
+	Since   string `yaml:"since"`
+	Message string `yaml:"message"`
+}
+
+func (yd *yamlDeprecated) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return value.Decode(&yd.Message)
+	}
+	var m map[string]string
+	if value.Decode(&m) != nil {
+		return fmt.Errorf("cannot decode deprecated")
+	}
+	for key := range m {
+		if key != "since" && key != "message" {
+			return fmt.Errorf("deprecated must be a string or a mapping with since and message")
+		}
+	}
+	yd.Since = m["since"]
+	yd.Message = m["message"]
+	return nil
+}
+
+var ubuntuAdjectives = map[string]string{
+	"18.04": "bionic",
+	"20.04": "focal",
+	"22.04": "jammy",
+	"22.10": "kinetic",
+}
+
+// ubuntuEndOfLife holds the Ubuntu versions that are no longer supported.
+var ubuntuEndOfLife = map[string]bool{
+	"14.04": true,
+	"16.04": true,
+	"18.04": true,
+	"20.04": true,
+	"20.10": true,
+	"21.04": true,
+	"21.10": true,
+	"22.10": true,
+	"23.04": true,
+	"23.10": true,
+	"24.10": true,
+	"25.04": true,
+}
+
+func parseRelease(fileName string, data []byte) (*Release, error) {
+	release := &Release{
+		Packages: make(map[string]*Package),
+		Archives: make(map[string]*Archive),
+	}
+
+	yamlVar := yamlRelease{}
+	dec := yaml.NewDecoder(bytes.NewBuffer(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&yamlVar)
+	if err != nil {
+		return nil, fmt.Errorf("%s: cannot parse release definition: %v", fileName, err)
+	}
+	if yamlVar.Format != yamlReleaseFormat {
+		return nil, fmt.Errorf("%s: expected format %q, got %q", fileName, yamlReleaseFormat, yamlVar.Format)
+	}
+	if len(yamlVar.Archives) == 0 {
+		return nil, fmt.Errorf("%s: no archives defined", fileName)
+	}
+
+	for archiveName, details := range yamlVar.Archives {
+		if details.Version == "" {
+			return nil, fmt.Errorf("%s: archive %q missing version field", fileName, archiveName)
+		}
+		switch details.Distribution {
+		case "":
+			details.Distribution = "ubuntu"
+		case "ubuntu", "debian":
+		default:
+			return nil, fmt.Errorf("%s: archive %q has unsupported distribution %q", fileName, archiveName, details.Distribution)
+		}
+		isUbuntu := details.Distribution == "ubuntu"
+		if len(details.Suites) == 0 {
+			var adjective string
+			if isUbuntu {
+				adjective = ubuntuAdjectives[details.Version]
+			}
+			if adjective == "" {
+				return nil, fmt.Errorf("%s: archive %q missing suites field", fileName, archiveName)
+			}
+			details.Suites = []string{adjective}
+		}
+		if len(details.Components) == 0 {
+			return nil, fmt.Errorf("%s: archive %q: no components defined", fileName, archiveName)
+		}
+		for _, component := range details.Components {
+			if component == "" {
+				return nil, fmt.Errorf("%s: archive %q has an empty component", fileName, archiveName)
+			}
+		}
+		if details.URL == "" {
+			if !isUbuntu {
+				return nil, fmt.Errorf("%s: archive %q missing url field", fileName, archiveName)
+			}
+		} else if u, err := url.Parse(details.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%s: archive %q has invalid url: %q", fileName, archiveName, details.URL)
+		}
+		if len(yamlVar.Archives) == 1 {
+			details.Default = true
+		} else if details.Default && release.DefaultArchive != "" {
+			return nil, fmt.Errorf("%s: more than one default archive: %s, %s", fileName, release.DefaultArchive, archiveName)
+		}
+		if details.Default {
+			release.DefaultArchive = archiveName
+		}
+		release.Archives[archiveName] = &Archive{
+			Name:         archiveName,
+			Version:      details.Version,
+			Suites:       details.Suites,
+			Components:   details.Components,
+			URL:          details.URL,
+			Priority:     details.Priority,
+			Distribution: details.Distribution,
+		}
+	}
+
+	if release.DefaultArchive == "" {
+		var top, tie *Archive
+		for _, info := range sortedArchives(release.Archives) {
+			if top == nil || info.Priority > top.Priority {
+				top, tie = info, nil
+			} else if info.Priority == top.Priority && tie == nil {
+				tie = info
+			}
+		}
+		if tie != nil {
+			return nil, fmt.Errorf("%s: archives %q and %q have the same priority and none is the default", fileName, top.Name, tie.Name)
+		}
+		release.DefaultArchive = top.Name
+	}
+
+	for prefix, pkgName := range yamlVar.Replaces {
+		if !path.IsAbs(prefix) || path.Clean(prefix) != strings.TrimSuffix(prefix, "/") && prefix != "/" {
+			return nil, fmt.Errorf("%s: invalid replaces path prefix: %s", fileName, prefix)
+		}
+		if release.Replaces == nil {
+			release.Replaces = make(map[string]string)
+		}
+		release.Replaces[prefix] = pkgName
+	}
+
+	return release, err
+}
+
+// parsePackage parses the slice definitions for the package in data,
+// read from pkgPath, and the ones included by it via readInclude.
+func parsePackage(pkgName, pkgPath string, data []byte, readInclude func(incPath string) ([]byte, error)) (*Package, error) {
+	pkg := Package{
+		Name:   pkgName,
+		Path:   pkgPath,
+		Slices: make(map[string]*Slice),
+	}
+
+	positions := newYamlPositions(data)
+	if sliceName, ok := positions.duplicateSlice(); ok {
+		return nil, fmt.Errorf("%s: slice %q defined more than once", pkgPath, sliceName)
+	}
+
+	yamlPkg := yamlPackage{}
+	dec := yaml.NewDecoder(bytes.NewBuffer(data))
+	dec.KnownFields(true)
+	err := dec.Decode(&yamlPkg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse package %q slice definitions: %v", pkgName, err)
+	}
+	if yamlPkg.Name != pkg.Name {
+		if yamlPkg.Name != "" && strings.HasPrefix(pkg.Name, yamlPkg.Name+".") {
+			return nil, fmt.Errorf("%s: invalid architecture in filename: %q", pkgPath, pkg.Name[len(yamlPkg.Name)+1:])
+		}
+		return nil, fmt.Errorf("%s: filename and 'package' field (%q) disagree", pkgPath, yamlPkg.Name)
+	}
+	pkg.Archive = yamlPkg.Archive
+	if yamlPkg.MaxTotalFiles < 0 {
+		return nil, fmt.Errorf("%s: invalid max-total-files: %d", pkgPath, yamlPkg.MaxTotalFiles)
+	}
+	pkg.MaxTotalFiles = yamlPkg.MaxTotalFiles
+
+	pkgEssential, err := parseEssential(yamlPkg.Essential, pkgPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Slices from included files are merged, while remembering where
+	// each one was defined for reporting errors.
+	sliceFiles := make(map[string]string, len(yamlPkg.Slices))
+	for sliceName := range yamlPkg.Slices {
+		sliceFiles[sliceName] = pkgPath
+	}
+	filePositions := map[string]yamlPositions{pkgPath: positions}
+	for _, inc := range yamlPkg.Include {
+		incPath, err := includePath(pkgPath, inc)
+		if err != nil {
+			return nil, err
+		}
+		incData, err := readInclude(incPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cannot read included slice definitions: %v", pkgPath, err)
+		}
+		incPositions := newYamlPositions(incData)
+		if sliceName, ok := incPositions.duplicateSlice(); ok {
+			return nil, fmt.Errorf("%s: slice %q defined more than once", incPath, sliceName)
+		}
+		yamlInc := yamlInclude{}
+		dec := yaml.NewDecoder(bytes.NewBuffer(incData))
+		dec.KnownFields(true)
+		err = dec.Decode(&yamlInc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cannot parse included slice definitions: %v", incPath, err)
+		}
+		incNames := make([]string, 0, len(yamlInc.Slices))
+		for sliceName := range yamlInc.Slices {
+			incNames = append(incNames, sliceName)
+		}
+		sort.Strings(incNames)
+		for _, sliceName := range incNames {
+			if other, ok := sliceFiles[sliceName]; ok {
+				return nil, fmt.Errorf("slice %q defined in both %s and %s", sliceName, other, incPath)
+			}
+			if yamlPkg.Slices == nil {
+				yamlPkg.Slices = make(map[string]yamlSlice)
+			}
+			yamlPkg.Slices[sliceName] = yamlInc.Slices[sliceName]
+			sliceFiles[sliceName] = incPath
+		}
+		filePositions[incPath] = incPositions
+	}
+
+	for sliceName, yamlSlice := range yamlPkg.Slices {
+		match := snameExp.FindStringSubmatch(sliceName)
+		if match == nil {
+			return nil, fmt.Errorf("invalid slice name %q in %s", sliceName, pkgPath)
+		}
+
+		slice := &Slice{
+			Package: pkgName,
+			Name:    sliceName,
+			Scripts: SliceScripts{
+				Mutate: yamlSlice.Mutate,
+			},
+			Experimental: yamlSlice.Experimental,
+		}
+
+		sliceEssential, err := parseEssential(yamlSlice.Essential, pkgPath)
+		if err != nil {
+			return nil, err
+		}
+		self := SliceKey{pkgName, sliceName}
+		for _, sliceKey := range append(pkgEssential, sliceEssential...) {
+			if sliceKey == self {
+				continue
+			}
+			found := false
+			for _, old := range slice.Essential {
+				if old == sliceKey {
+					found = true
+					break
+				}
+			}
+			if !found {
+				slice.Essential = append(slice.Essential, sliceKey)
+			}
+		}
+
+		if yamlSlice.Deprecated != nil {
+			if yamlSlice.Deprecated.Message == "" {
+				return nil, fmt.Errorf("slice %s_%s has empty deprecation message", pkgName, sliceName)
+			}
+			slice.Deprecated = &SliceDeprecation{
+				Since:   yamlSlice.Deprecated.Since,
+				Message: yamlSlice.Deprecated.Message,
+			}
+		}
+
+		if len(yamlSlice.Contents) > 0 {
+			slice.Contents = make(map[string]PathInfo, len(yamlSlice.Contents))
+		}
+		for contPath, yamlPath := range yamlSlice.Contents {
+			info, err := parsePath(pkgName, sliceName, contPath, yamlPath)
+			if err != nil {
+				file := sliceFiles[sliceName]
+				if line, col := filePositions[file].content(sliceName, contPath); line > 0 {
+					return nil, fmt.Errorf("%v (%s:%d:%d)", err, file, line, col)
+				}
+				return nil, err
+			}
+			slice.Contents[contPath] = info
+		}
+
+		pkg.Slices[sliceName] = slice
+	}
+
+	return &pkg, err
+}
+
+// parseEssential parses the slice references in an essential list, in
+// which <package>_* entries are kept for expandEssentials.
+func parseEssential(refNames []string, pkgPath string) ([]SliceKey, error) {
+	var keys []SliceKey
+	for _, refName := range refNames {
+		if match := wnameExp.FindStringSubmatch(refName); match != nil {
+			keys = append(keys, SliceKey{match[1], "*"})
+			continue
+		}
+		sliceKey, err := ParseSliceKey(refName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slice reference %q in %s", refName, pkgPath)
+		}
+		keys = append(keys, sliceKey)
+	}
+	return keys, nil
+}
+
+// parsePath returns the details for the content path declared by the
+// slice as described by yamlPath, which may be nil.
+func parsePath(pkgName, sliceName, contPath string, yamlPath *yamlPath) (PathInfo, error) {
+	err := checkContentPath(pkgName, sliceName, contPath)
+	if err != nil {
+		return PathInfo{}, err
+	}
+	isDir := strings.HasSuffix(contPath, "/")
+	var kinds = make([]PathKind, 0, 3)
+	var info string
+	var mode uint
+	var mutable bool
+	var uid, gid int
+	var until PathUntil
+	var arch []string
+	var textAppend bool
+	if strings.ContainsAny(contPath, "*?") {
+		if yamlPath != nil {
+			if !yamlPath.SameContent(&zeroPath) {
+				return PathInfo{}, fmt.Errorf("slice %s_%s path %s has invalid wildcard options",
+					pkgName, sliceName, contPath)
+			}
+		}
+		kinds = append(kinds, GlobPath)
+	}
+	if yamlPath != nil {
+		base := uint(0644)
+		if yamlPath.Dir {
+			base = 0755
+		}
+		mode, err = yamlPath.Mode.resolve(base)
+		if err != nil {
+			return PathInfo{}, fmt.Errorf("slice %s_%s path %q: %v", pkgName, sliceName, contPath, err)
+		}
+		mutable = yamlPath.Mutable
+		uid, gid = yamlPath.UID, yamlPath.GID
+		if uid < 0 || gid < 0 {
+			return PathInfo{}, fmt.Errorf("slice %s_%s path %s has negative uid or gid", pkgName, sliceName, contPath)
+		}
+		if yamlPath.Dir {
+			if !strings.HasSuffix(contPath, "/") {
+				return PathInfo{}, fmt.Errorf("slice %s_%s path %s must end in / for 'make' to be valid",
+					pkgName, sliceName, contPath)
+			}
+			kinds = append(kinds, DirPath)
+		}
+		if yamlPath.Text != nil {
+			kinds = append(kinds, TextPath)
+			info = yamlPath.Text.text
+			textAppend = yamlPath.Text.append
+		}
+		if len(yamlPath.Symlink) > 0 {
+			kinds = append(kinds, SymlinkPath)
+			info = yamlPath.Symlink
+		}
+		if len(yamlPath.Hardlink) > 0 {
+			kinds = append(kinds, HardlinkPath)
+			info = yamlPath.Hardlink
+		}
+		if len(yamlPath.Copy) > 0 {
+			kinds = append(kinds, CopyPath)
+			info = yamlPath.Copy
+			if info == contPath {
+				info = ""
+			}
+		}
+		until = yamlPath.Until
+		switch until {
+		case UntilNone, UntilMutate:
+		default:
+			return PathInfo{}, fmt.Errorf("slice %s_%s has invalid 'until' for path %s: %q", pkgName, sliceName, contPath, until)
+		}
+		arch = yamlPath.Arch.list
+		for _, s := range arch {
+			if deb.ValidateArch(s) != nil {
+				return PathInfo{}, fmt.Errorf("slice %s_%s has invalid 'arch' for path %s: %q", pkgName, sliceName, contPath, s)
+			}
+		}
+	}
+	if len(kinds) == 0 {
+		kinds = append(kinds, CopyPath)
+	}
+	if len(kinds) != 1 {
+		return PathInfo{}, fmt.Errorf("slice %s_%s path %q: multiple content kinds specified", pkgName, sliceName, contPath)
+	}
+	if isDir && (kinds[0] == TextPath || kinds[0] == SymlinkPath || kinds[0] == HardlinkPath || kinds[0] == CopyPath && yamlPath != nil && yamlPath.Copy != "") {
+		return PathInfo{}, fmt.Errorf("slice %s_%s path %s must not end in / for '%s' to be valid",
+			pkgName, sliceName, contPath, kinds[0])
+	}
+	switch kinds[0] {
+	case CopyPath:
+		if info != "" && (!path.IsAbs(info) || path.Clean(info) != info) {
+			return PathInfo{}, fmt.Errorf("slice %s_%s has invalid copy source for path %s: %s", pkgName, sliceName, contPath, info)
+		}
+	case SymlinkPath:
+		if !path.IsAbs(info) && !yamlPath.Relative {
+			return PathInfo{}, fmt.Errorf("slice %s_%s path %q: symlink target must be absolute", pkgName, sliceName, contPath)
+		}
+		if escapesRoot(path.Dir(contPath), info) {
+			return PathInfo{}, fmt.Errorf("slice %s_%s has symlink escaping the root for path %s: %s", pkgName, sliceName, contPath, info)
+		}
+	case HardlinkPath:
+		if !path.IsAbs(info) || path.Clean(info) != info || info == contPath {
+			return PathInfo{}, fmt.Errorf("slice %s_%s has invalid hardlink target for path %s: %s", pkgName, sliceName, contPath, info)
+		}
+	}
+	if yamlPath != nil && yamlPath.Relative && kinds[0] != SymlinkPath {
+		return PathInfo{}, fmt.Errorf("slice %s_%s path %s has relative but no symlink", pkgName, sliceName, contPath)
+	}
+	if yamlPath != nil && yamlPath.SHA256 != "" {
+		if kinds[0] != TextPath {
+			return PathInfo{}, fmt.Errorf("slice %s_%s path %s has sha256 but no text", pkgName, sliceName, contPath)
+		}
+		sum := sha256.Sum256([]byte(info))
+		if digest := hex.EncodeToString(sum[:]); digest != strings.ToLower(yamlPath.SHA256) {
+			return PathInfo{}, fmt.Errorf("slice %s_%s path %s has text with sha256 %s, expected %s",
+				pkgName, sliceName, contPath, digest, yamlPath.SHA256)
+		}
+	}
+	if mutable && kinds[0] != TextPath && (kinds[0] != CopyPath || isDir) {
+		return PathInfo{}, fmt.Errorf("slice %s_%s mutable is not a regular file: %s", pkgName, sliceName, contPath)
+	}
+	return PathInfo{
+		Kind:    kinds[0],
+		Info:    info,
+		Mode:    mode,
+		UID:     uid,
+		GID:     gid,
+		Mutable: mutable,
+		Until:   until,
+		Arch:    arch,
+		Append:  textAppend,
+	}, nil
+}
+
+// checkContentPath returns an error if contPath is not a valid content
+// path for the slice, independently of the details declared for it.
+func checkContentPath(pkgName, sliceName, contPath string) error {
+	comparePath := strings.TrimSuffix(contPath, "/")
+	if strings.IndexByte(contPath, 0) >= 0 {
+		return fmt.Errorf("slice %s_%s has null byte in content path: %q", pkgName, sliceName, contPath)
+	}
+	if base := path.Base(contPath); base == "." || base == ".." {
+		return fmt.Errorf("slice %s_%s has reserved name %q in content path: %s", pkgName, sliceName, base, contPath)
+	}
+	if !path.IsAbs(contPath) || path.Clean(contPath) != comparePath {
+		return fmt.Errorf("slice %s_%s has invalid content path: %s", pkgName, sliceName, contPath)
+	}
+	if strings.ContainsAny(contPath, "*?") {
+		if err := checkGlob(contPath); err != nil {
+			return fmt.Errorf("slice %s_%s has invalid wildcard path %s: %v", pkgName, sliceName, contPath, err)
+		}
+	}
+	return nil
+}
+
+// checkPathInfo returns an error if the details of a content path that
+// was not obtained via parsePath disagree with the path itself.
+func checkPathInfo(pkgName, sliceName, contPath string, info *PathInfo) error {
+	err := checkContentPath(pkgName, sliceName, contPath)
+	if err != nil {
+		return err
+	}
+	isDir := strings.HasSuffix(contPath, "/")
+	switch info.Kind {
+	case DirPath:
+		if !isDir {
+			return fmt.Errorf("slice %s_%s path %s must end in / for 'make' to be valid",
+				pkgName, sliceName, contPath)
+		}
+	case TextPath, SymlinkPath, HardlinkPath, CopyPath:
+		if isDir && (info.Kind != CopyPath || info.Info != "") {
+			return fmt.Errorf("slice %s_%s path %s must not end in / for '%s' to be valid",
+				pkgName, sliceName, contPath, info.Kind)
+		}
+	}
+	return nil
+}
+
+// checkMutate returns an error if the mutation script of the slice has
+// invalid syntax, or reads or writes a literal path that is not declared
+// by the slice or by the slices it transitively requires.
+func (r *Release) checkMutate(slice *Slice) error {
+	if slice.Scripts.Mutate == "" {
+		return nil
+	}
+	file, err := syntax.Parse("mutate", slice.Scripts.Mutate, 0)
+	if err != nil {
+		return fmt.Errorf("slice %s has invalid mutate script: %v", slice, err)
+	}
+	var refs []string
+	syntax.Walk(file, func(node syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if !ok || len(call.Args) == 0 {
+			return true
+		}
+		dot, ok := call.Fn.(*syntax.DotExpr)
+		if !ok || dot.Name.Name != "read" && dot.Name.Name != "write" {
+			return true
+		}
+		if x, ok := dot.X.(*syntax.Ident); !ok || x.Name != "content" {
+			return true
+		}
+		if lit, ok := call.Args[0].(*syntax.Literal); ok && lit.Token == syntax.STRING {
+			refs = append(refs, lit.Value.(string))
+		}
+		return true
+	})
+	if len(refs) == 0 {
+		return nil
+	}
+	keys, err := closure(r.Packages, []SliceKey{{slice.Package, slice.Name}}, nil)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		refPath := path.Clean(ref)
+		declared := false
+		for _, key := range keys {
+			for contPath, info := range r.Packages[key.Package].Slices[key.Slice].Contents {
+				if contPath == refPath || contPath == refPath+"/" || info.Kind == GlobPath && strdist.GlobPath(contPath, refPath) {
+					declared = true
+					break
+				}
+			}
+			if declared {
+				break
+			}
+		}
+		if !declared {
+			return fmt.Errorf("slice %s mutate script references undeclared path %s", slice, ref)
+		}
+	}
+	return nil
+}
+
+// checkGlob returns an error if the glob pattern uses syntax that is not
+// supported by strdist.GlobPath, which only knows about ?, * and **.
+func checkGlob(pattern string) error {
+	if i := strings.IndexAny(pattern, "[]{}\\"); i >= 0 {
+		return fmt.Errorf("unsupported character %q", pattern[i])
+	}
+	if strings.Contains(pattern, "***") {
+		return fmt.Errorf("more than two consecutive '*'")
+	}
+	return nil
+}
+
+// escapesRoot returns whether the target path, resolved relative to dir
+// when not absolute, goes above the root via ".." components.
+func escapesRoot(dir, target string) bool {
+	depth := 0
+	if !path.IsAbs(target) {
+		depth = len(strings.Split(strings.Trim(dir, "/"), "/"))
+		if dir == "/" {
+			depth = 0
+		}
+	}
+	for _, name := range strings.Split(target, "/") {
+		switch name {
+		case "", ".":
+		case "..":
+			if depth == 0 {
+				return true
+			}
+			depth--
+		default:
+			depth++
+		}
+	}
+	return false
+}
+
+// sortedArchives returns the archives ordered by name.
+func sortedArchives(archives map[string]*Archive) []*Archive {
+	sorted := make([]*Archive, 0, len(archives))
+	for _, info := range archives {
+		sorted = append(sorted, info)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	return sorted
+}
+
+// SelectOptions holds optional settings for SelectWithOptions.
+type SelectOptions struct {
+	// MaxSlices limits the number of slices in the selection, including
+	// the ones pulled in as essentials. Zero means no limit.
+	MaxSlices int
+
+	// VerifyAgainstLock, if set, holds a previously computed selection
+	// which the new one must match. Slices added or removed since then
+	// are reported as an error.
+	VerifyAgainstLock *Selection
+
+	// MaxPathDeclarations limits the number of selected slices that may
+	// declare the same path, even if identically. Zero means no limit.
+	MaxPathDeclarations int
+
+	// Archives, if set, holds the opened release archives by name. Each
+	// selected package is then obtained from the archive with the highest
+	// priority that contains it, rather than from its default archive.
+	Archives map[string]archive.Archive
+
+	// Substitutions maps slices to other slices that are selected in their
+	// place, whether requested directly or reached as essentials.
+	Substitutions map[SliceKey]SliceKey
+
+	// Arch, if set, is the architecture the selection is for. Paths not
+	// included for it are left out of the selected slices, which are then
+	// copies of the release ones, before checking for conflicts.
+	Arch string
+
+	// AllowExperimental permits experimental slices in the selection.
+	AllowExperimental bool
+
+	// RecordReasons sets Selection.Reasons with why each slice was
+	// selected.
+	RecordReasons bool
+
+	// Provider, if set, lists the files shipped by packages. Wildcard
+	// paths from different packages may overlap, and only conflict when
+	// they match the same file shipped by both packages, which is checked
+	// when the provider is set.
+	Provider FileLister
+
+	// DryRun skips the checks for conflicting paths, so that a selection
+	// that could not be extracted is still returned for inspection with
+	// methods such as ModeDivergences.
+	DryRun bool
+}
+
+func Select(release *Release, slices []SliceKey) (*Selection, error) {
+	return SelectWithOptions(release, slices, nil)
+}
+
+// SelectWithOptions selects the provided slices and all of their
+// essentials from the release. Once the selected slices are known, errors
+// such as conflicts between them are returned along with the partial
+// selection, for diagnostics.
+func SelectWithOptions(release *Release, slices []SliceKey, options *SelectOptions) (*Selection, error) {
+	logf("Selecting slices...")
+
+	if options == nil {
+		options = &SelectOptions{}
+	}
+
+	selection := &Selection{
+		Release: release,
+	}
+
+	for _, key := range NormalizeSliceKeys(mapKeys(options.Substitutions)) {
+		other := options.Substitutions[key]
+		for _, k := range []SliceKey{key, other} {
+			if pkg, ok := release.Packages[k.Package]; !ok || pkg.Slices[k.Slice] == nil {
+				return nil, fmt.Errorf("cannot substitute %s with %s: slice %s not found", key, other, k)
+			}
+		}
+	}
+
+	sorted, err := order(release.Packages, NormalizeSliceKeys(slices), options.Substitutions)
+	if err != nil {
+		return nil, err
+	}
+	if options.MaxSlices > 0 && len(sorted) > options.MaxSlices {
+		return nil, fmt.Errorf("selection has %d slices, more than the maximum of %d", len(sorted), options.MaxSlices)
+	}
+	selection.Slices = make([]*Slice, len(sorted))
+	for i, key := range sorted {
+		selection.Slices[i] = release.Packages[key.Package].Slices[key.Slice]
+	}
+	if !options.AllowExperimental {
+		for _, slice := range selection.Slices {
+			if slice.Experimental {
+				return selection, fmt.Errorf("cannot select experimental slice %s without allowing experimental slices", slice)
+			}
+		}
+	}
+
+	if options.Arch != "" {
+		err = deb.ValidateArch(options.Arch)
+		if err != nil {
+			return selection, err
+		}
+		selection.Slices = archSlices(selection.Slices, options.Arch)
+	}
+	if !options.DryRun {
+		paths, err := release.checkPaths(selection.Slices)
+		if err != nil {
+			return selection, err
+		}
+		err = checkHardlinks(paths)
+		if err != nil {
+			return selection, err
+		}
+		if options.Provider != nil {
+			err = release.checkGlobFiles(selection.Slices, options.Provider)
+			if err != nil {
+				return selection, err
+			}
+		}
+	}
+
+	if options.MaxPathDeclarations > 0 {
+		err = checkDeclarations(selection.Slices, options.MaxPathDeclarations)
+		if err != nil {
+			return selection, err
+		}
+	}
+
+	if options.Archives != nil {
+		err = selection.resolveArchives(options.Archives)
+		if err != nil {
+			return selection, err
+		}
+	}
+
+	for _, slice := range selection.Slices {
+		deprecated := slice.Deprecated
+		if deprecated == nil {
+			continue
+		}
+		var warning string
+		if deprecated.Since != "" {
+			warning = fmt.Sprintf("slice %s is deprecated since %s: %s", slice, deprecated.Since, deprecated.Message)
+		} else {
+			warning = fmt.Sprintf("slice %s is deprecated: %s", slice, deprecated.Message)
+		}
+		logf("Warning: %s", warning)
+		selection.Warnings = append(selection.Warnings, warning)
+	}
+
+	requested := make(map[SliceKey]bool)
+	for _, key := range slices {
+		requested[substitute(options.Substitutions, key)] = true
+	}
+	for _, slice := range selection.Slices {
+		if !requested[SliceKey{slice.Package, slice.Name}] {
+			continue
+		}
+		if len(slice.Contents) == 0 && len(slice.Essential) == 0 && slice.Scripts.Mutate == "" {
+			warning := fmt.Sprintf("slice %s has no contents and no essentials", slice)
+			logf("Warning: %s", warning)
+			selection.Warnings = append(selection.Warnings, warning)
+		}
+	}
+
+	if options.VerifyAgainstLock != nil {
+		err = checkDrift(options.VerifyAgainstLock, selection)
+		if err != nil {
+			return selection, err
+		}
+	}
+
+	if options.RecordReasons {
+		selection.Reasons = reasons(release.Packages, NormalizeSliceKeys(slices), options.Substitutions)
+	}
+
+	return selection, nil
+}
+
+// reasons returns why each slice in the closure of keys is reached,
+// walking essentials in the same order as closure does.
+func reasons(pkgs map[string]*Package, keys []SliceKey, subst map[SliceKey]SliceKey) map[SliceKey]Reason {
+	result := make(map[SliceKey]Reason)
+	var pending []SliceKey
+	for _, key := range keys {
+		key = substitute(subst, key)
+		if _, ok := result[key]; !ok {
+			result[key] = Reason{Requested: true}
+			pending = append(pending, key)
+		}
+	}
+	for i := 0; i < len(pending); i++ {
+		key := pending[i]
+		for _, req := range pkgs[key.Package].Slices[key.Slice].Essential {
+			req = substitute(subst, req)
+			if _, ok := result[req]; !ok {
+				result[req] = Reason{RequiredBy: key}
+				pending = append(pending, req)
+			}
+		}
+	}
+	return result
 }
 
-func (ya *yamlArch) UnmarshalYAML(value *yaml.Node) error {
-	var s string
-	var l []string
-	if value.Decode(&s) == nil {
-		ya.list = []string{s}
-	} else if value.Decode(&l) == nil {
-		ya.list = l
-	} else {
-		return fmt.Errorf("cannot decode arch")
+// checkGlobFiles returns an error if wildcard paths from slices of
+// different packages match the same file shipped by both packages,
+// according to the provider. Files taken over by one of the packages via
+// the release replaces map are not a conflict.
+func (r *Release) checkGlobFiles(slices []*Slice, provider FileLister) error {
+	type claim struct {
+		slice *Slice
+		glob  string
+	}
+	claims := make(map[string]claim)
+	for _, slice := range slices {
+		globs := make([]string, 0, len(slice.Contents))
+		for path, info := range slice.Contents {
+			if info.Kind == GlobPath {
+				globs = append(globs, path)
+			}
+		}
+		if len(globs) == 0 {
+			continue
+		}
+		sort.Strings(globs)
+		files := provider.Files(slice.Package)
+		for _, glob := range globs {
+			for _, file := range files {
+				if !strdist.GlobPath(glob, file) {
+					continue
+				}
+				old, ok := claims[file]
+				if !ok {
+					claims[file] = claim{slice, glob}
+					continue
+				}
+				if old.slice.Package == slice.Package {
+					continue
+				}
+				if winner := r.replacer(file); winner == old.slice.Package || winner == slice.Package {
+					continue
+				}
+				if disjointArch(old.slice.Contents[old.glob].Arch, slice.Contents[glob].Arch) {
+					continue
+				}
+				first, second := old, claim{slice, glob}
+				if first.slice.Package > second.slice.Package {
+					first, second = second, first
+				}
+				return fmt.Errorf("slices %s and %s conflict on %s via %s and %s",
+					first.slice, second.slice, file, first.glob, second.glob)
+			}
+		}
 	}
-	// Validate arch correctness later for a better error message.
 	return nil
 }
 
-type yamlSlice struct {
-	Essential []string             `yaml:"essential"`
-	Contents  map[string]*yamlPath `yaml:"contents"`
-	Mutate    string               `yaml:"mutate"`
+// archSlices returns copies of the provided slices holding only the paths
+// included for arch, or the slices themselves if arch is empty.
+func archSlices(slices []*Slice, arch string) []*Slice {
+	if arch == "" {
+		return slices
+	}
+	result := make([]*Slice, len(slices))
+	for i, slice := range slices {
+		copy := *slice
+		copy.Contents = make(map[string]PathInfo, len(slice.Contents))
+		for path, info := range slice.Contents {
+			if info.Included(arch) {
+				copy.Contents[path] = info
+			}
+		}
+		result[i] = &copy
+	}
+	return result
 }
 
-var ubuntuAdjectives = map[string]string{
-	"18.04": "bionic",
-	"20.04": "focal",
-	"22.04": "jammy",
-	"22.10": "kinetic",
+// LoadOptions holds optional settings for LoadAndSelect.
+type LoadOptions struct {
+	ReadOptions
+	SelectOptions
 }
 
-func parseRelease(baseDir, filePath string, data []byte) (*Release, error) {
-	release := &Release{
-		Path:     baseDir,
-		Packages: make(map[string]*Package),
-		Archives: make(map[string]*Archive),
+// LoadAndSelect reads the release in dir and selects the provided slices
+// from it, as done by ReadReleaseWithOptions and SelectWithOptions.
+func LoadAndSelect(dir string, keys []SliceKey, options *LoadOptions) (*Selection, error) {
+	if options == nil {
+		options = &LoadOptions{}
 	}
-
-	fileName := stripBase(baseDir, filePath)
-
-	yamlVar := yamlRelease{}
-	dec := yaml.NewDecoder(bytes.NewBuffer(data))
-	dec.KnownFields(true)
-	err := dec.Decode(&yamlVar)
+	release, err := ReadReleaseWithOptions(dir, &options.ReadOptions)
 	if err != nil {
-		return nil, fmt.Errorf("%s: cannot parse release definition: %v", fileName, err)
+		return nil, err
 	}
-	if yamlVar.Format != yamlReleaseFormat {
-		return nil, fmt.Errorf("%s: expected format %q, got %q", fileName, yamlReleaseFormat, yamlVar.Format)
+	return SelectWithOptions(release, keys, &options.SelectOptions)
+}
+
+// resolveArchives sets the archive for every selected package to the one
+// with the highest priority among the archives containing it, unless the
+// package is pinned to an archive.
+func (s *Selection) resolveArchives(archives map[string]archive.Archive) error {
+	s.PackageArchives = make(map[string]string)
+	for _, slice := range s.Slices {
+		if _, ok := s.PackageArchives[slice.Package]; ok {
+			continue
+		}
+		if pkg := s.Release.Packages[slice.Package]; pkg.Pinned {
+			if index := archives[pkg.Archive]; index == nil || !index.Exists(pkg.Name) {
+				return fmt.Errorf("package %q not found in archive %q", pkg.Name, pkg.Archive)
+			}
+			s.PackageArchives[pkg.Name] = pkg.Archive
+			continue
+		}
+		var top, tie *Archive
+		for _, info := range sortedArchives(s.Release.Archives) {
+			index := archives[info.Name]
+			if index == nil || !index.Exists(slice.Package) {
+				continue
+			}
+			if top == nil || info.Priority > top.Priority {
+				top, tie = info, nil
+			} else if info.Priority == top.Priority && tie == nil {
+				tie = info
+			}
+		}
+		if top == nil {
+			return fmt.Errorf("package %q not found in any archive", slice.Package)
+		}
+		if tie != nil {
+			return fmt.Errorf("package %q is available in archives %q and %q with the same priority", slice.Package, top.Name, tie.Name)
+		}
+		s.PackageArchives[slice.Package] = top.Name
 	}
-	if len(yamlVar.Archives) == 0 {
-		return nil, fmt.Errorf("%s: no archives defined", fileName)
+	return nil
+}
+
+// ArchiveFor returns the name of the archive the package is obtained from.
+func (s *Selection) ArchiveFor(pkg string) string {
+	if name, ok := s.PackageArchives[pkg]; ok {
+		return name
 	}
+	return s.Release.Packages[pkg].Archive
+}
 
-	for archiveName, details := range yamlVar.Archives {
-		if details.Version == "" {
-			return nil, fmt.Errorf("%s: archive %q missing version field", fileName, archiveName)
+// checkHardlinks returns an error if any hardlink in the selected paths
+// targets a path that is not a regular file provided by the selection,
+// either explicitly or via a wildcard.
+func checkHardlinks(paths map[string]*Slice) error {
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+	for _, linkPath := range sorted {
+		slice := paths[linkPath]
+		if slice.Contents[linkPath].Kind != HardlinkPath {
+			continue
 		}
-		if len(details.Suites) == 0 {
-			adjective := ubuntuAdjectives[details.Version]
-			if adjective == "" {
-				return nil, fmt.Errorf("%s: archive %q missing suites field", fileName, archiveName)
+		target := slice.Contents[linkPath].Info
+		provided := false
+		if targetSlice, ok := paths[target]; ok {
+			kind := targetSlice.Contents[target].Kind
+			provided = kind == CopyPath || kind == TextPath
+		} else {
+			for _, globPath := range sorted {
+				if paths[globPath].Contents[globPath].Kind == GlobPath && strdist.GlobPath(globPath, target) {
+					provided = true
+					break
+				}
 			}
-			details.Suites = []string{adjective}
 		}
-		if len(details.Components) == 0 {
-			return nil, fmt.Errorf("%s: archive %q missing components field", fileName, archiveName)
-		}
-		if len(yamlVar.Archives) == 1 {
-			details.Default = true
-		} else if details.Default && release.DefaultArchive != "" {
-			return nil, fmt.Errorf("%s: more than one default archive: %s, %s", fileName, release.DefaultArchive, archiveName)
+		if !provided {
+			return fmt.Errorf("slice %s path %s has hardlink target not provided by the selection: %s", slice, linkPath, target)
 		}
-		if details.Default {
-			release.DefaultArchive = archiveName
+	}
+	return nil
+}
+
+// checkDeclarations returns an error if any path is declared by more
+// than max of the provided slices.
+func checkDeclarations(slices []*Slice, max int) error {
+	counts := make(map[string]int)
+	for _, slice := range slices {
+		for path := range slice.Contents {
+			counts[path]++
 		}
-		release.Archives[archiveName] = &Archive{
-			Name:       archiveName,
-			Version:    details.Version,
-			Suites:     details.Suites,
-			Components: details.Components,
+	}
+	var over []string
+	for path, count := range counts {
+		if count > max {
+			over = append(over, path)
 		}
 	}
+	if len(over) == 0 {
+		return nil
+	}
+	sort.Strings(over)
+	return fmt.Errorf("path %s is declared by %d slices, more than the maximum of %d", over[0], counts[over[0]], max)
+}
 
-	return release, err
+func mapKeys(m map[SliceKey]SliceKey) []SliceKey {
+	keys := make([]SliceKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
 }
 
-func parsePackage(baseDir, pkgName, pkgPath string, data []byte) (*Package, error) {
-	pkg := Package{
-		Name:   pkgName,
-		Path:   pkgPath,
-		Slices: make(map[string]*Slice),
+// checkDrift returns an error listing the slices added and removed
+// in the selection when compared to the locked one.
+func checkDrift(lock, selection *Selection) error {
+	locked := make(map[string]bool)
+	for _, slice := range lock.Slices {
+		locked[slice.String()] = true
+	}
+	selected := make(map[string]bool)
+	var added, removed []string
+	for _, slice := range selection.Slices {
+		selected[slice.String()] = true
+		if !locked[slice.String()] {
+			added = append(added, slice.String())
+		}
+	}
+	for name := range locked {
+		if !selected[name] {
+			removed = append(removed, name)
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	var details []string
+	if len(added) > 0 {
+		details = append(details, "added "+strings.Join(added, ", "))
 	}
+	if len(removed) > 0 {
+		details = append(details, "removed "+strings.Join(removed, ", "))
+	}
+	return fmt.Errorf("selection differs from lock: %s", strings.Join(details, "; "))
+}
 
-	yamlPkg := yamlPackage{}
-	dec := yaml.NewDecoder(bytes.NewBuffer(data))
-	dec.KnownFields(true)
-	err := dec.Decode(&yamlPkg)
-	if err != nil {
-		return nil, fmt.Errorf("cannot parse package %q slice definitions: %v", pkgName, err)
+// LockDrift returns the keys of the slices in the locked selection that
+// are no longer defined in release, sorted by package and slice name.
+func LockDrift(lock *Selection, release *Release) []SliceKey {
+	var missing []SliceKey
+	for _, slice := range lock.Slices {
+		if pkg, ok := release.Packages[slice.Package]; ok && pkg.Slices[slice.Name] != nil {
+			continue
+		}
+		missing = append(missing, SliceKey{slice.Package, slice.Name})
 	}
-	if yamlPkg.Name != pkg.Name {
-		return nil, fmt.Errorf("%s: filename and 'package' field (%q) disagree", pkgPath, yamlPkg.Name)
+	return NormalizeSliceKeys(missing)
+}
+
+// UnusedPackages returns the sorted names of all packages in the release
+// which have none of their slices in the selection.
+func (s *Selection) UnusedPackages() []string {
+	used := make(map[string]bool)
+	for _, slice := range s.Slices {
+		used[slice.Package] = true
 	}
-	pkg.Archive = yamlPkg.Archive
+	var unused []string
+	for name := range s.Release.Packages {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
 
-	zeroPath := yamlPath{}
-	for sliceName, yamlSlice := range yamlPkg.Slices {
-		match := snameExp.FindStringSubmatch(sliceName)
-		if match == nil {
-			return nil, fmt.Errorf("invalid slice name %q in %s", sliceName, pkgPath)
+// AppendedText returns the concatenation of the text appended to the
+// provided path by the selected slices, in selection order, and whether
+// any of them appends to it.
+func (s *Selection) AppendedText(path string) (string, bool) {
+	var text strings.Builder
+	found := false
+	for _, slice := range s.Slices {
+		info, ok := slice.Contents[path]
+		if ok && info.Append {
+			text.WriteString(info.Info)
+			found = true
 		}
+	}
+	return text.String(), found
+}
 
-		slice := &Slice{
-			Package: pkgName,
-			Name:    sliceName,
-			Scripts: SliceScripts{
-				Mutate: yamlSlice.Mutate,
-			},
+// RequiredDirs returns the sorted list of directories that must exist for
+// the selected contents, including the explicitly made ones and all of
+// their parents. Directories are suffixed with "/", and the root directory
+// is omitted. Glob paths only require the parents of their first wildcard.
+func (s *Selection) RequiredDirs() []string {
+	dirs := make(map[string]bool)
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if info.Kind == GlobPath {
+				contPath = contPath[:strings.IndexAny(contPath, "*?")]
+				contPath = contPath[:strings.LastIndexByte(contPath, '/')+1]
+			} else if info.Kind != DirPath {
+				contPath = path.Dir(contPath)
+			}
+			for contPath = path.Clean(contPath); contPath != "/"; contPath = path.Dir(contPath) {
+				if dirs[contPath+"/"] {
+					break
+				}
+				dirs[contPath+"/"] = true
+			}
 		}
+	}
+	list := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		list = append(list, dir)
+	}
+	sort.Strings(list)
+	return list
+}
 
-		for _, refName := range yamlSlice.Essential {
-			sliceKey, err := ParseSliceKey(refName)
-			if err != nil {
-				return nil, fmt.Errorf("invalid slice reference %q in %s", refName, pkgPath)
+// ExplicitDirs returns the sorted list of directories explicitly made by
+// the selected slices, each followed by a space and its octal mode. Unlike
+// with RequiredDirs, implicit parent directories are not included.
+func (s *Selection) ExplicitDirs() []string {
+	dirs := make(map[string]uint)
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if info.Kind != DirPath {
+				continue
 			}
-			slice.Essential = append(slice.Essential, sliceKey)
+			mode := info.Mode
+			if mode == 0 {
+				mode = 0755
+			}
+			dirs[contPath] = mode
 		}
+	}
+	list := make([]string, 0, len(dirs))
+	for dir, mode := range dirs {
+		list = append(list, fmt.Sprintf("%s %04o", dir, mode))
+	}
+	sort.Strings(list)
+	return list
+}
 
-		if len(yamlSlice.Contents) > 0 {
-			slice.Contents = make(map[string]PathInfo, len(yamlSlice.Contents))
+// ModeDivergence describes a path declared by several selected slices
+// with the same content except for its mode.
+type ModeDivergence struct {
+	Path string
+
+	// Slices holds the slices declaring the path, in selection order,
+	// and Modes the mode each of them declares it with.
+	Slices []SliceKey
+	Modes  []uint
+}
+
+// ModeDivergences returns the paths declared by more than one slice with
+// the same content but different modes, sorted by path. Such paths are
+// conflicts, so they are only found in selections made with DryRun set.
+func (s *Selection) ModeDivergences() []ModeDivergence {
+	declared := make(map[string][]*Slice)
+	for _, slice := range s.Slices {
+		for contPath := range slice.Contents {
+			declared[contPath] = append(declared[contPath], slice)
 		}
-		for contPath, yamlPath := range yamlSlice.Contents {
-			isDir := strings.HasSuffix(contPath, "/")
-			comparePath := contPath
-			if isDir {
-				comparePath = comparePath[:len(comparePath)-1]
-			}
-			if !path.IsAbs(contPath) || path.Clean(contPath) != comparePath {
-				return nil, fmt.Errorf("slice %s_%s has invalid content path: %s", pkgName, sliceName, contPath)
-			}
-			var kinds = make([]PathKind, 0, 3)
-			var info string
-			var mode uint
-			var mutable bool
-			var until PathUntil
-			var arch []string
-			if strings.ContainsAny(contPath, "*?") {
-				if yamlPath != nil {
-					if !yamlPath.SameContent(&zeroPath) {
-						return nil, fmt.Errorf("slice %s_%s path %s has invalid wildcard options",
-							pkgName, sliceName, contPath)
-					}
-				}
-				kinds = append(kinds, GlobPath)
+	}
+	var list []ModeDivergence
+	for contPath, slices := range declared {
+		if len(slices) < 2 {
+			continue
+		}
+		first := slices[0].Contents[contPath]
+		divergence := ModeDivergence{Path: contPath}
+		same, diverges := true, false
+		for _, slice := range slices {
+			info := slice.Contents[contPath]
+			diverges = diverges || info.Mode != first.Mode
+			info.Mode = first.Mode
+			if !info.SameContent(&first) {
+				same = false
+				break
 			}
-			if yamlPath != nil {
-				mode = yamlPath.Mode
-				mutable = yamlPath.Mutable
-				if yamlPath.Dir {
-					if !strings.HasSuffix(contPath, "/") {
-						return nil, fmt.Errorf("slice %s_%s path %s must end in / for 'make' to be valid",
-							pkgName, sliceName, contPath)
-					}
-					kinds = append(kinds, DirPath)
-				}
-				if yamlPath.Text != nil {
-					kinds = append(kinds, TextPath)
-					info = *yamlPath.Text
-				}
-				if len(yamlPath.Symlink) > 0 {
-					kinds = append(kinds, SymlinkPath)
-					info = yamlPath.Symlink
-				}
-				if len(yamlPath.Copy) > 0 {
-					kinds = append(kinds, CopyPath)
-					info = yamlPath.Copy
-					if info == contPath {
-						info = ""
-					}
-				}
-				until = yamlPath.Until
-				switch until {
-				case UntilNone, UntilMutate:
-				default:
-					return nil, fmt.Errorf("slice %s_%s has invalid 'until' for path %s: %q", pkgName, sliceName, contPath, until)
-				}
-				arch = yamlPath.Arch.list
-				for _, s := range arch {
-					if deb.ValidateArch(s) != nil {
-						return nil, fmt.Errorf("slice %s_%s has invalid 'arch' for path %s: %q", pkgName, sliceName, contPath, s)
-					}
-				}
+			divergence.Slices = append(divergence.Slices, SliceKey{slice.Package, slice.Name})
+			divergence.Modes = append(divergence.Modes, slice.Contents[contPath].Mode)
+		}
+		if same && diverges {
+			list = append(list, divergence)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// UntilMutatePaths returns the sorted list of selected paths that must be
+// removed once the mutation scripts have run. A path is only included when
+// every selected slice declaring it is marked with "until: mutate".
+func (s *Selection) UntilMutatePaths() []string {
+	until := make(map[string]bool)
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if s.Replaced(slice, contPath) {
+				continue
 			}
-			if len(kinds) == 0 {
-				kinds = append(kinds, CopyPath)
+			if marked, ok := until[contPath]; !ok || marked {
+				until[contPath] = info.Until == UntilMutate
 			}
-			if len(kinds) != 1 {
-				list := make([]string, len(kinds))
-				for i, s := range kinds {
-					list[i] = string(s)
-				}
-				return nil, fmt.Errorf("conflict in slice %s_%s definition for path %s: %s", pkgName, sliceName, contPath, strings.Join(list, ", "))
+		}
+	}
+	var list []string
+	for contPath, marked := range until {
+		if marked {
+			list = append(list, contPath)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Paths returns the details of every path installed by the selection,
+// merged across the selected slices. Text appended by several slices is
+// combined, and paths taken over by another package are reported as
+// declared by it. The parent directories of made directories, which are
+// implicitly created with mode 0755, are included as well.
+func (s *Selection) Paths() map[string]PathInfo {
+	paths := make(map[string]PathInfo)
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if s.Replaced(slice, contPath) {
+				continue
 			}
-			if mutable && kinds[0] != TextPath && (kinds[0] != CopyPath || isDir) {
-				return nil, fmt.Errorf("slice %s_%s mutable is not a regular file: %s", pkgName, sliceName, contPath)
+			if _, ok := paths[contPath]; ok {
+				continue
 			}
-			slice.Contents[contPath] = PathInfo{
-				Kind:    kinds[0],
-				Info:    info,
-				Mode:    mode,
-				Mutable: mutable,
-				Until:   until,
-				Arch:    arch,
+			if info.Append {
+				info.Info, _ = s.AppendedText(contPath)
 			}
+			paths[contPath] = info
 		}
-
-		pkg.Slices[sliceName] = slice
 	}
-
-	return &pkg, err
+	for contPath, info := range paths {
+		if info.Kind != DirPath {
+			continue
+		}
+		for dir := path.Dir(path.Clean(contPath)); dir != "/"; dir = path.Dir(dir) {
+			if _, ok := paths[dir+"/"]; !ok {
+				paths[dir+"/"] = PathInfo{Kind: DirPath, Mode: 0755}
+			}
+		}
+	}
+	return paths
 }
 
-func stripBase(baseDir, path string) string {
-	// Paths must be clean for this to work correctly.
-	return strings.TrimPrefix(path, baseDir+string(filepath.Separator))
+// TreeNode is an entry in the content tree of a selection.
+type TreeNode struct {
+	// Name is the last component of the path, or "/" for the root.
+	Name string
+	// Path is the full path, with a trailing slash for directories.
+	Path string
+	// Kind is the kind of the declared path, or empty for directories
+	// which are only implied by the content within them.
+	Kind PathKind
+	Info string
+	Mode uint
+	// Children holds the entries within directories, sorted by name.
+	Children []*TreeNode
 }
 
-func Select(release *Release, slices []SliceKey) (*Selection, error) {
-	logf("Selecting slices...")
+// Tree returns the content declared by the selected slices as a tree of
+// nodes rooted at "/", with the parent directories of every path.
+func (s *Selection) Tree() *TreeNode {
+	root := &TreeNode{Name: "/", Path: "/"}
+	nodes := map[string]*TreeNode{"/": root}
+	var node func(nodePath string) *TreeNode
+	node = func(nodePath string) *TreeNode {
+		if n, ok := nodes[nodePath]; ok {
+			return n
+		}
+		name := strings.TrimSuffix(nodePath, "/")
+		parentPath := path.Dir(name)
+		if parentPath != "/" {
+			parentPath += "/"
+		}
+		parent := node(parentPath)
+		n := &TreeNode{Name: path.Base(name), Path: nodePath}
+		parent.Children = append(parent.Children, n)
+		nodes[nodePath] = n
+		return n
+	}
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if s.Replaced(slice, contPath) {
+				continue
+			}
+			n := node(contPath)
+			n.Kind = info.Kind
+			n.Info = info.Info
+			n.Mode = info.Mode
+		}
+	}
+	var sortChildren func(n *TreeNode)
+	sortChildren = func(n *TreeNode) {
+		sort.Slice(n.Children, func(i, j int) bool {
+			return n.Children[i].Name < n.Children[j].Name
+		})
+		for _, child := range n.Children {
+			sortChildren(child)
+		}
+	}
+	sortChildren(root)
+	return root
+}
 
-	selection := &Selection{
-		Release: release,
+// SlicesForPath returns the selected slices that install the provided
+// path, either explicitly or via a wildcard matching it, in selection
+// order. Slices whose declaration of the path is taken over by another
+// package are not included.
+func (s *Selection) SlicesForPath(path string) []*Slice {
+	var slices []*Slice
+	for _, slice := range s.Slices {
+		for contPath, info := range slice.Contents {
+			if contPath == path && !s.Replaced(slice, path) || info.Kind == GlobPath && strdist.GlobPath(contPath, path) {
+				slices = append(slices, slice)
+				break
+			}
+		}
 	}
+	return slices
+}
 
-	sorted, err := order(release.Packages, slices)
-	if err != nil {
-		return nil, err
+// Replaced returns whether the provided path declared by slice is taken over
+// by a different package in the selection, via the release replaces map.
+func (s *Selection) Replaced(slice *Slice, path string) bool {
+	winner := s.Release.replacer(path)
+	if winner == "" || winner == slice.Package {
+		return false
 	}
-	selection.Slices = make([]*Slice, len(sorted))
-	for i, key := range sorted {
-		selection.Slices[i] = release.Packages[key.Package].Slices[key.Slice]
+	for _, other := range s.Slices {
+		if _, ok := other.Contents[path]; ok && other.Package == winner {
+			return true
+		}
 	}
+	return false
+}
 
-	paths := make(map[string]*Slice)
-	for _, new := range selection.Slices {
-		for newPath, newInfo := range new.Contents {
-			if old, ok := paths[newPath]; ok {
-				oldInfo := old.Contents[newPath]
-				if !newInfo.SameContent(&oldInfo) || (newInfo.Kind == CopyPath || newInfo.Kind == GlobPath) && new.Package != old.Package {
-					if old.Package > new.Package || old.Package == new.Package && old.Name > new.Name {
-						old, new = new, old
-					}
-					return nil, fmt.Errorf("slices %s and %s conflict on %s", old, new, newPath)
-				}
+// PathsByKind returns the paths declared by the selected slices grouped
+// by their kind, with each group sorted.
+func (s *Selection) PathsByKind() map[PathKind][]string {
+	seen := make(map[string]bool)
+	result := make(map[PathKind][]string)
+	for _, slice := range s.Slices {
+		for path, info := range slice.Contents {
+			if seen[path] {
 				continue
 			}
-			paths[newPath] = new
+			seen[path] = true
+			result[info.Kind] = append(result[info.Kind], path)
 		}
 	}
+	for _, paths := range result {
+		sort.Strings(paths)
+	}
+	return result
+}
 
-	return selection, nil
+// SquashfsPseudoFiles returns mksquashfs pseudo file definitions, sorted by
+// path, for the directories and symlinks created by the selection and for
+// the mode and ownership of files with an explicit mode or text files with
+// an explicit owner.
+func (s *Selection) SquashfsPseudoFiles() ([]string, error) {
+	infos := make(map[string]PathInfo)
+	for _, slice := range s.Slices {
+		for path, info := range slice.Contents {
+			if _, ok := infos[path]; !ok {
+				infos[path] = info
+			}
+		}
+	}
+	paths := make([]string, 0, len(infos))
+	for path := range infos {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var lines []string
+	for _, path := range paths {
+		info := infos[path]
+		if strings.ContainsAny(path, "\n\"") || (info.Kind == SymlinkPath || info.Kind == HardlinkPath) && strings.ContainsAny(info.Info, "\n\"") {
+			return nil, fmt.Errorf("cannot represent path in pseudo file: %q", path)
+		}
+		name := strings.TrimPrefix(strings.TrimSuffix(path, "/"), "/")
+		if strings.ContainsAny(name, " \t") {
+			name = `"` + name + `"`
+		}
+		switch info.Kind {
+		case DirPath:
+			mode := info.Mode
+			if mode == 0 {
+				mode = 0755
+			}
+			lines = append(lines, fmt.Sprintf("%s d %04o %d %d", name, mode, info.UID, info.GID))
+		case SymlinkPath:
+			lines = append(lines, fmt.Sprintf("%s s 0777 %d %d %s", name, info.UID, info.GID, info.Info))
+		case HardlinkPath:
+			lines = append(lines, fmt.Sprintf("%s l %s", name, strings.TrimPrefix(info.Info, "/")))
+		case CopyPath, TextPath:
+			mode := info.Mode
+			if mode == 0 && info.Kind == TextPath && (info.UID != 0 || info.GID != 0) {
+				mode = 0644
+			}
+			if mode != 0 {
+				lines = append(lines, fmt.Sprintf("%s m %04o %d %d", name, mode, info.UID, info.GID))
+			}
+		}
+	}
+	return lines, nil
+}
+
+// TargetPaths returns the content of the selection keyed by the respective
+// path joined to root. Directory paths keep their trailing slash. Paths
+// that would fall outside of root once joined are reported as an error.
+func (s *Selection) TargetPaths(root string) (map[string]PathInfo, error) {
+	root = filepath.Clean(root)
+	result := make(map[string]PathInfo)
+	for _, slice := range s.Slices {
+		for path, info := range slice.Contents {
+			target := filepath.Join(root, path)
+			if rel, err := filepath.Rel(root, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return nil, fmt.Errorf("slice %s path %s escapes the target root", slice, path)
+			}
+			if strings.HasSuffix(path, "/") && target != root {
+				target += "/"
+			}
+			if _, ok := result[target]; !ok {
+				result[target] = info
+			}
+		}
+	}
+	return result, nil
 }
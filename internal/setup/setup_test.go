@@ -1,12 +1,17 @@
 package setup_test
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"testing/fstest"
 
 	. "gopkg.in/check.v1"
 
+	"github.com/canonical/chisel/internal/archive"
 	"github.com/canonical/chisel/internal/setup"
 	"github.com/canonical/chisel/internal/testutil"
 )
@@ -16,8 +21,10 @@ type setupTest struct {
 	input     map[string]string
 	slices    map[string]*setup.Slice
 	release   *setup.Release
+	relopts   *setup.ReadOptions
 	relerror  string
 	selslices []setup.SliceKey
+	selopts   *setup.SelectOptions
 	selection *setup.Selection
 	selerror  string
 }
@@ -38,6 +45,41 @@ var setupTests = []setupTest{{
 		`,
 	},
 	relerror: `chisel.yaml: no archives defined`,
+}, {
+	summary: "Missing archive components",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu": no components defined`,
+}, {
+	summary: "Empty list of archive components",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: []
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu": no components defined`,
+}, {
+	summary: "Empty archive component",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, ""]
+		`,
+	},
+	relerror: `chisel.yaml: archive "ubuntu" has an empty component`,
 }, {
 	summary: "Enforce matching filename and package name",
 	input: map[string]string{
@@ -66,10 +108,11 @@ var setupTests = []setupTest{{
 
 		Archives: map[string]*setup.Archive{
 			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy", "jammy-security"},
-				Components: []string{"main", "other"},
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy", "jammy-security"},
+				Components:   []string{"main", "other"},
+				Distribution: "ubuntu",
 			},
 		},
 		Packages: map[string]*setup.Package{
@@ -109,10 +152,11 @@ var setupTests = []setupTest{{
 
 		Archives: map[string]*setup.Archive{
 			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
 			},
 		},
 		Packages: map[string]*setup.Package{
@@ -170,10 +214,11 @@ var setupTests = []setupTest{{
 
 		Archives: map[string]*setup.Archive{
 			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
 			},
 		},
 		Packages: map[string]*setup.Package{
@@ -284,6 +329,7 @@ var setupTests = []setupTest{{
 			Package: "mypkg1",
 			Name:    "myslice1",
 		}},
+		Warnings: []string{"slice mypkg1_myslice1 has no contents and no essentials"},
 	},
 }, {
 	summary: "Selection with dependencies",
@@ -314,6 +360,72 @@ var setupTests = []setupTest{{
 			},
 		}},
 	},
+}, {
+	summary: "Selection within the maximum number of slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg1_myslice1]}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice2"}},
+	selopts:   &setup.SelectOptions{MaxSlices: 2},
+}, {
+	summary: "Selection over the maximum number of slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg1_myslice1]}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice2"}},
+	selopts:   &setup.SelectOptions{MaxSlices: 1},
+	selerror:  `selection has 2 slices, more than the maximum of 1`,
+}, {
+	summary: "Selection matching the lock",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg1_myslice1]}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice2"}},
+	selopts: &setup.SelectOptions{
+		VerifyAgainstLock: &setup.Selection{
+			Slices: []*setup.Slice{
+				{Package: "mypkg1", Name: "myslice2"},
+				{Package: "mypkg1", Name: "myslice1"},
+			},
+		},
+	},
+}, {
+	summary: "Selection drifted from the lock",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg1_myslice1]}
+				myslice3: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice2"}},
+	selopts: &setup.SelectOptions{
+		VerifyAgainstLock: &setup.Selection{
+			Slices: []*setup.Slice{
+				{Package: "mypkg1", Name: "myslice2"},
+				{Package: "mypkg1", Name: "myslice3"},
+				{Package: "mypkg2", Name: "myslice1"},
+			},
+		},
+	},
+	selerror: `selection differs from lock: added mypkg1_myslice1; removed mypkg1_myslice3, mypkg2_myslice1`,
 }, {
 	summary: "Selection with matching paths don't conflict",
 	input: map[string]string{
@@ -342,507 +454,3385 @@ var setupTests = []setupTest{{
 	},
 	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}, {"mypkg2", "myslice1"}},
 }, {
-	summary: "Conflicting paths across slices",
+	summary: "Paths with different text conflict",
 	input: map[string]string{
 		"slices/mydir/mypkg1.yaml": `
 			package: mypkg1
 			slices:
 				myslice1:
 					contents:
-						/path1:
+						/path1: {text: one}
 				myslice2:
 					contents:
-						/path1: {copy: /other}
+						/path1: {text: two}
 		`,
 	},
 	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Conflicting paths across packages",
+	summary: "Paths with different mode conflict",
 	input: map[string]string{
 		"slices/mydir/mypkg1.yaml": `
 			package: mypkg1
 			slices:
 				myslice1:
 					contents:
-						/path1:
-		`,
-		"slices/mydir/mypkg2.yaml": `
-			package: mypkg2
-			slices:
-				myslice1:
-					contents:
-						/path1:
-		`,
-	},
-	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /path1",
-}, {
-	summary: "Directories must be suffixed with /",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
+						/path1: {text: same, mode: 0600}
+				myslice2:
 					contents:
-						/foo: {make: true}
+						/path1: {text: same, mode: 0644}
 		`,
 	},
-	relerror: `slice mypkg_myslice path /foo must end in / for 'make' to be valid`,
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Slice path must be clean",
+	summary: "Paths with different symlink target conflict",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/foo/../:
-		`,
-	},
-	relerror: `slice mypkg_myslice has invalid content path: /foo/../`,
-}, {
-	summary: "Slice path must be absolute",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
+						/path1: {symlink: /link1}
+				myslice2:
 					contents:
-						./foo/:
+						/path1: {symlink: /link2}
 		`,
 	},
-	relerror: `slice mypkg_myslice has invalid content path: ./foo/`,
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Globbing support",
+	summary: "Paths with different mutable flag conflict",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
 				myslice1:
 					contents:
-						/file/*:
+						/path1: {text: same, mutable: true}
 				myslice2:
 					contents:
-						/another/**:
+						/path1: {text: same}
 		`,
 	},
-	release: &setup.Release{
-		DefaultArchive: "ubuntu",
-
-		Archives: map[string]*setup.Archive{
-			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
-			},
-		},
-		Packages: map[string]*setup.Package{
-			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
-				Slices: map[string]*setup.Slice{
-					"myslice1": {
-						Package: "mypkg",
-						Name:    "myslice1",
-						Contents: map[string]setup.PathInfo{
-							"/file/*": {Kind: "glob"},
-						},
-					},
-					"myslice2": {
-						Package: "mypkg",
-						Name:    "myslice2",
-						Contents: map[string]setup.PathInfo{
-							"/another/**": {Kind: "glob"},
-						},
-					},
-				},
-			},
-		},
-	},
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Conflicting globs",
+	summary: "Paths with different kind conflict",
 	input: map[string]string{
 		"slices/mydir/mypkg1.yaml": `
 			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/file/f*obar:
-		`,
-		"slices/mydir/mypkg2.yaml": `
-			package: mypkg2
-			slices:
-				myslice:
+						/path1: {text: /link}
+				myslice2:
 					contents:
-						/file/foob*r:
+						/path1: {symlink: /link}
 		`,
 	},
-	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/f\*obar and /file/foob\*r`,
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Conflicting globs and plain copies",
+	summary: "Appended text across slices and packages",
 	input: map[string]string{
 		"slices/mydir/mypkg1.yaml": `
 			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/file/foobar:
+						/path1: {text: {append: "one "}}
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+					contents:
+						/path1: {text: {append: "three"}}
 		`,
 		"slices/mydir/mypkg2.yaml": `
 			package: mypkg2
 			slices:
-				myslice:
+				myslice1:
+					essential:
+						- mypkg1_myslice1
 					contents:
-						/file/foob*r:
+						/path1: {text: {append: "two "}}
 		`,
 	},
-	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar and /file/foob\*r`,
+	selslices: []setup.SliceKey{{"mypkg1", "myslice2"}},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg1",
+			Name:    "myslice1",
+			Contents: map[string]setup.PathInfo{
+				"/path1": {Kind: "text", Info: "one ", Append: true},
+			},
+		}, {
+			Package:   "mypkg2",
+			Name:      "myslice1",
+			Essential: []setup.SliceKey{{"mypkg1", "myslice1"}},
+			Contents: map[string]setup.PathInfo{
+				"/path1": {Kind: "text", Info: "two ", Append: true},
+			},
+		}, {
+			Package:   "mypkg1",
+			Name:      "myslice2",
+			Essential: []setup.SliceKey{{"mypkg2", "myslice1"}},
+			Contents: map[string]setup.PathInfo{
+				"/path1": {Kind: "text", Info: "three", Append: true},
+			},
+		}},
+	},
 }, {
-	summary: "Conflicting matching globs",
+	summary: "Appended text conflicts with plain text",
 	input: map[string]string{
 		"slices/mydir/mypkg1.yaml": `
 			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/file/foob*r:
-		`,
-		"slices/mydir/mypkg2.yaml": `
-			package: mypkg2
-			slices:
-				myslice:
+						/path1: {text: {append: "one"}}
+				myslice2:
 					contents:
-						/file/foob*r:
+						/path1: {text: "one"}
 		`,
 	},
-	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foob\*r`,
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Conflicting globs in same package is okay",
+	summary: "Appended text must agree on mode",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
 				myslice1:
 					contents:
-						/file/foob*r:
-						/file/f*r:
+						/path1: {text: {append: "one"}, mode: 0600}
 				myslice2:
 					contents:
-						/file/foob*r:
-						/file/f*obar:
+						/path1: {text: {append: "two"}}
 		`,
 	},
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Invalid glob options",
+	summary: "Invalid text mapping",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/file/foob*r: {text: foo}
+						/path1: {text: {prepend: "one"}}
 		`,
 	},
-	relerror: `slice mypkg_myslice path /file/foob\*r has invalid wildcard options`,
+	relerror: `cannot parse package "mypkg1" slice definitions: text must be a string or an append mapping`,
 }, {
-	summary: "Until is an okay option for globs",
+	summary: "Conflicting paths across slices",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/file/foob*r: {until: mutate}
+						/path1:
+				myslice2:
+					contents:
+						/path1: {copy: /other}
 		`,
 	},
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
 }, {
-	summary: "Mutable does not work for directories extractions",
+	summary: "Conflicting paths across packages",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/path/: {mutable: true}
+						/path1:
 		`,
-	},
-	relerror: `slice mypkg_myslice mutable is not a regular file: /path/`,
-}, {
-	summary: "Mutable does not work for directory making",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/path/: {make: true, mutable: true}
+						/path1:
 		`,
 	},
-	relerror: `slice mypkg_myslice mutable is not a regular file: /path/`,
+	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /path1",
 }, {
-	summary: "Mutable does not work for symlinks",
+	summary: "Replaces resolves conflicts under a path prefix",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
-					contents:
-						/path: {symlink: /other, mutable: true}
-		`,
-	},
-	relerror: `slice mypkg_myslice mutable is not a regular file: /path`,
-}, {
-	summary: "Until checks its value for validity",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
-					contents:
-						/path: {until: foo}
-		`,
-	},
-	relerror: `slice mypkg_myslice has invalid 'until' for path /path: "foo"`,
-}, {
-	summary: "Arch checks its value for validity",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
-					contents:
-						/path: {arch: foo}
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+			replaces:
+				/usr/lib/foo/: mypkg2
 		`,
-	},
-	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
-}, {
-	summary: "Arch checks its value for validity",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/path: {arch: [i386, foo]}
+						/usr/lib/foo/lib.so:
+						/usr/lib/foo/data/**:
 		`,
-	},
-	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo"`,
-}, {
-	summary: "Single architecture selection",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/path: {arch: i386}
+						/usr/lib/foo/lib.so:
+						/usr/lib/foo/data/file:
 		`,
 	},
 	release: &setup.Release{
 		DefaultArchive: "ubuntu",
+		Replaces:       map[string]string{"/usr/lib/foo/": "mypkg2"},
 
 		Archives: map[string]*setup.Archive{
 			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
 			},
 		},
 		Packages: map[string]*setup.Package{
-			"mypkg": {
+			"mypkg1": {
 				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name:    "mypkg1",
+				Path:    "slices/mydir/mypkg1.yaml",
 				Slices: map[string]*setup.Slice{
-					"myslice": {
-						Package: "mypkg",
-						Name:    "myslice",
+					"myslice1": {
+						Package: "mypkg1",
+						Name:    "myslice1",
 						Contents: map[string]setup.PathInfo{
-							"/path": {Kind: "copy", Arch: []string{"i386"}},
+							"/usr/lib/foo/lib.so":  {Kind: "copy"},
+							"/usr/lib/foo/data/**": {Kind: "glob"},
 						},
 					},
 				},
 			},
-		},
-	},
-}, {
-	summary: "Multiple architecture selection",
-	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
-			slices:
-				myslice:
-					contents:
-						/path: {arch: [i386, amd64]}
-		`,
-	},
-	release: &setup.Release{
-		DefaultArchive: "ubuntu",
-
-		Archives: map[string]*setup.Archive{
-			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
-			},
-		},
-		Packages: map[string]*setup.Package{
-			"mypkg": {
+			"mypkg2": {
 				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
+				Name:    "mypkg2",
+				Path:    "slices/mydir/mypkg2.yaml",
 				Slices: map[string]*setup.Slice{
-					"myslice": {
-						Package: "mypkg",
-						Name:    "myslice",
+					"myslice1": {
+						Package: "mypkg2",
+						Name:    "myslice1",
 						Contents: map[string]setup.PathInfo{
-							"/path": {Kind: "copy", Arch: []string{"i386", "amd64"}},
+							"/usr/lib/foo/lib.so":    {Kind: "copy"},
+							"/usr/lib/foo/data/file": {Kind: "copy"},
 						},
 					},
 				},
 			},
 		},
 	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}},
 }, {
-	summary: "Text can be empty",
+	summary: "Replaces does not resolve conflicts outside its path prefix",
 	input: map[string]string{
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+			replaces:
+				/usr/lib/foo/: mypkg2
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 			slices:
-				myslice:
+				myslice1:
 					contents:
-						/nonempty: {text: "foo"}
-						/empty: {text: ""}
+						/usr/lib/bar/lib.so:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/bar/lib.so:
 		`,
 	},
-	release: &setup.Release{
-		DefaultArchive: "ubuntu",
-
-		Archives: map[string]*setup.Archive{
-			"ubuntu": {
-				Name:       "ubuntu",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
-			},
-		},
-		Packages: map[string]*setup.Package{
-			"mypkg": {
-				Archive: "ubuntu",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
-				Slices: map[string]*setup.Slice{
-					"myslice": {
-						Package: "mypkg",
-						Name:    "myslice",
-						Contents: map[string]setup.PathInfo{
-							"/nonempty": {Kind: "text", Info: "foo"},
-							"/empty":    {Kind: "text", Info: ""},
-						},
-					},
-				},
-			},
-		},
+	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /usr/lib/bar/lib.so",
+}, {
+	summary: "Replaces matches whole path components",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+			replaces:
+				/usr/lib/foo: mypkg2
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/foo/lib.so:
+				myslice2:
+					contents:
+						/usr/lib/foobar/lib.so:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/foo/lib.so:
+				myslice2:
+					contents:
+						/usr/lib/foobar/lib.so:
+		`,
 	},
+	relerror: "slices mypkg1_myslice2 and mypkg2_myslice2 conflict on /usr/lib/foobar/lib.so",
 }, {
-	summary: "Multiple archives",
+	summary: "Replaces must refer to a defined package",
 	input: map[string]string{
 		"chisel.yaml": `
 			format: chisel-v1
 			archives:
-				foo:
+				ubuntu:
 					version: 22.04
 					components: [main, universe]
-					suites: [jammy]
-					default: true
-				bar:
+			replaces:
+				/usr/lib/foo/: mypkg2
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+		`,
+	},
+	relerror: `chisel.yaml: replaces /usr/lib/foo/ with undefined package "mypkg2"`,
+}, {
+	summary: "Replaces must use absolute path prefixes",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
 					version: 22.04
-					components: [universe]
-					suites: [jammy-updates]
+					components: [main, universe]
+			replaces:
+				usr/lib/: mypkg1
 		`,
-		"slices/mydir/mypkg.yaml": `
-			package: mypkg
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
 		`,
 	},
-	release: &setup.Release{
-		DefaultArchive: "foo",
-
-		Archives: map[string]*setup.Archive{
-			"foo": {
-				Name:       "foo",
-				Version:    "22.04",
-				Suites:     []string{"jammy"},
-				Components: []string{"main", "universe"},
-			},
-			"bar": {
-				Name:       "bar",
-				Version:    "22.04",
-				Suites:     []string{"jammy-updates"},
-				Components: []string{"universe"},
-			},
-		},
-		Packages: map[string]*setup.Package{
-			"mypkg": {
-				Archive: "foo",
-				Name:    "mypkg",
-				Path:    "slices/mydir/mypkg.yaml",
-				Slices:  map[string]*setup.Slice{},
-			},
-		},
+	relerror: `chisel.yaml: invalid replaces path prefix: usr/lib/`,
+}, {
+	summary: "Symlink and directory on the same location in one slice",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {symlink: /other}
+						/path1/: {make: true}
+		`,
 	},
-}}
-
-const defaultChiselYaml = `
-	format: chisel-v1
-	archives:
-		ubuntu:
-			version: 22.04
-			components: [main, universe]
-`
-
-func (s *S) TestParseRelease(c *C) {
-	for _, test := range setupTests {
-		c.Logf("Summary: %s", test.summary)
-
-		if _, ok := test.input["chisel.yaml"]; !ok {
-			test.input["chisel.yaml"] = string(defaultChiselYaml)
-		}
-
-		dir := c.MkDir()
-		for path, data := range test.input {
-			fpath := filepath.Join(dir, path)
-			err := os.MkdirAll(filepath.Dir(fpath), 0755)
-			c.Assert(err, IsNil)
-			err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
-			c.Assert(err, IsNil)
-		}
-
-		release, err := setup.ReadRelease(dir)
-		if err != nil || test.relerror != "" {
-			if test.relerror != "" {
-				c.Assert(err, ErrorMatches, test.relerror)
-				continue
-			} else {
-				c.Assert(err, IsNil)
-			}
-		}
-
-		c.Assert(release.Path, Equals, dir)
-		release.Path = ""
-
-		if test.release != nil {
-			c.Assert(release, DeepEquals, test.release)
-		}
-
-		if test.selslices != nil {
-			selection, err := setup.Select(release, test.selslices)
-			if test.selerror != "" {
-				c.Assert(err, ErrorMatches, test.selerror)
-				continue
-			} else {
+	relerror: "slice mypkg1_myslice1 declares /path1 both as a symlink and as /path1/",
+}, {
+	summary: "Path declared with and without trailing slash in one slice",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {hardlink: /path2}
+						/path1/: {make: true}
+						/path2:
+		`,
+	},
+	relerror: "slice mypkg1_myslice1 declares both /path1 and /path1/",
+}, {
+	summary: "Paths sharing a prefix are distinct from a trailing slash",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1/: {make: true}
+						/path10:
+						/path1.d/:
+		`,
+	},
+}, {
+	summary: "Symlink and directory on the same location across slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {symlink: /other}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/path1/:
+		`,
+	},
+	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on symlink /path1 and /path1/",
+}, {
+	summary: "File and directory on the same location across slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/data:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/data/: {make: true}
+		`,
+	},
+	relerror: "slices mypkg1_myslice1 and mypkg2_myslice1 conflict on file /data and /data/ within it",
+}, {
+	summary: "File as parent of other content across slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/data/sub/file:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/data: {text: content}
+		`,
+	},
+	relerror: "slices mypkg2_myslice1 and mypkg1_myslice1 conflict on file /data and /data/sub/file within it",
+}, {
+	summary: "File as parent of other content in one slice",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/data:
+						/data/*.so:
+		`,
+	},
+	relerror: "slice mypkg1_myslice1 declares file /data and /data/\\*.so within it",
+}, {
+	summary: "Directory with content from other slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/data/: {make: true}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/data/file:
+						/data/sub/: {make: true}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg1",
+			Name:    "myslice1",
+			Contents: map[string]setup.PathInfo{
+				"/data/": {Kind: "dir"},
+			},
+		}, {
+			Package: "mypkg2",
+			Name:    "myslice1",
+			Contents: map[string]setup.PathInfo{
+				"/data/file": {Kind: "copy"},
+				"/data/sub/": {Kind: "dir"},
+			},
+		}},
+	},
+}, {
+	summary: "Symlink and file on the same location across slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {symlink: /other}
+				myslice2:
+					contents:
+						/path1: {text: data}
+		`,
+	},
+	relerror: "slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /path1",
+}, {
+	summary: "Directories must be suffixed with /",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo: {make: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /foo must end in / for 'make' to be valid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Copies must not be suffixed with /",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/: {copy: /bar/}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /foo/ must not end in / for 'copy' to be valid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Text must not be suffixed with /",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/: {text: data}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /foo/ must not end in / for 'text' to be valid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Symlinks must not be suffixed with /",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/: {symlink: /bar}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /foo/ must not end in / for 'symlink' to be valid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Copies, text, and symlinks work on file paths",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo: {copy: /bar}
+						/baz: {text: data}
+						/qux: {symlink: /bar}
+						/dir/:
+		`,
+	},
+}, {
+	summary: "Slice path must be clean",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/../:
+		`,
+	},
+	relerror: `slice mypkg_myslice has reserved name "\.\." in content path: /foo/../ \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Slice path must be clean in the middle",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/../bar:
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid content path: /foo/../bar \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Slice path cannot end in a dot",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/.:
+		`,
+	},
+	relerror: `slice mypkg_myslice has reserved name "\." in content path: /foo/. \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Slice path cannot contain null bytes",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						"/foo\0bar":
+		`,
+	},
+	relerror: `slice mypkg_myslice has null byte in content path: "/foo\\x00bar" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Slice path may have names starting with dots",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/foo/.bar:
+						/foo/..bar/:
+		`,
+	},
+}, {
+	summary: "Slice path must be absolute",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						./foo/:
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid content path: ./foo/ \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Globbing support",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/file/*:
+				myslice2:
+					contents:
+						/another/**:
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/file/*": {Kind: "glob"},
+						},
+					},
+					"myslice2": {
+						Package: "mypkg",
+						Name:    "myslice2",
+						Contents: map[string]setup.PathInfo{
+							"/another/**": {Kind: "glob"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Overlapping globs conflict on files shipped by both packages",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice:
+					contents:
+						/file/f*obar:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice:
+					contents:
+						/file/foob*r:
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice"}, {"mypkg2", "myslice"}},
+	selopts: &setup.SelectOptions{Provider: fileLister{
+		"mypkg1": {"/file/", "/file/foobar", "/file/fooobar"},
+		"mypkg2": {"/file/", "/file/foobar", "/file/foobaar"},
+	}},
+	selerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar via /file/f\*obar and /file/foob\*r`,
+}, {
+	summary: "Overlapping globs do not conflict without files shipped by both packages",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice:
+					contents:
+						/file/f*obar:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice:
+					contents:
+						/file/foob*r:
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice"}, {"mypkg2", "myslice"}},
+	selopts: &setup.SelectOptions{Provider: fileLister{
+		"mypkg1": {"/file/", "/file/fooobar"},
+		"mypkg2": {"/file/", "/file/foobaar"},
+	}},
+}, {
+	summary: "Conflicting globs and plain copies",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice:
+					contents:
+						/file/foobar:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice:
+					contents:
+						/file/foob*r:
+		`,
+	},
+	relerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar and /file/foob\*r`,
+}, {
+	summary: "Identical globs conflict on files shipped by both packages",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice:
+					contents:
+						/file/foob*r:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice:
+					contents:
+						/file/foob*r:
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice"}, {"mypkg2", "myslice"}},
+	selopts: &setup.SelectOptions{Provider: fileLister{
+		"mypkg1": {"/file/foobar"},
+		"mypkg2": {"/file/foobar"},
+	}},
+	selerror: `slices mypkg1_myslice and mypkg2_myslice conflict on /file/foobar via /file/foob\*r and /file/foob\*r`,
+}, {
+	summary: "Conflicting globs in same package is okay",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/file/foob*r:
+						/file/f*r:
+				myslice2:
+					contents:
+						/file/foob*r:
+						/file/f*obar:
+		`,
+	},
+}, {
+	summary: "Invalid glob options",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/file/foob*r: {text: foo}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /file/foob\*r has invalid wildcard options \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Until is an okay option for globs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/file/foob*r: {until: mutate}
+		`,
+	},
+}, {
+	summary: "Mutable does not work for directories extractions",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path/: {mutable: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path/ \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Mutable does not work for directory making",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path/: {make: true, mutable: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path/ \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Mutable does not work for symlinks",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {symlink: /other, mutable: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice mutable is not a regular file: /path \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Mutable works with text or copied content",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {text: initial, mutable: true}
+						/path2: {copy: /other, mutable: true}
+						/path3: {mutable: true}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path1": {Kind: "text", Info: "initial", Mutable: true},
+							"/path2": {Kind: "copy", Info: "/other", Mutable: true},
+							"/path3": {Kind: "copy", Mutable: true},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Mutable does not work for globs",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path/*: {mutable: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /path/\* has invalid wildcard options \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Until checks its value for validity",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {until: foo}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'until' for path /path: "foo" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Arch checks its value for validity",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {arch: foo}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Arch checks its value for validity",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {arch: [i386, foo]}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid 'arch' for path /path: "foo" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Single architecture selection",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {arch: i386}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path": {Kind: "copy", Arch: []string{"i386"}},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Multiple architecture selection",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {arch: [i386, amd64]}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path": {Kind: "copy", Arch: []string{"i386", "amd64"}},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Paths for different architectures do not conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/libfoo.so: {text: amd64, arch: amd64}
+						/usr/lib/*/libbar.so: {arch: [amd64, i386]}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/libfoo.so: {text: arm64, arch: arm64}
+						/usr/lib/aarch64-linux-gnu/libbar.so: {arch: arm64}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}},
+	selopts:   &setup.SelectOptions{Arch: "arm64"},
+}, {
+	summary: "Paths sharing an architecture conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/libbar.so: {text: foo, arch: [amd64, arm64]}
+				myslice2:
+					contents:
+						/usr/lib/libbar.so: {text: bar, arch: [arm64, i386]}
+		`,
+	},
+	relerror: `slices mypkg1_myslice1 and mypkg1_myslice2 conflict on /usr/lib/libbar.so`,
+}, {
+	summary: "Selection architecture must be valid",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}},
+	selopts:   &setup.SelectOptions{Arch: "foo"},
+	selerror:  `invalid package architecture: foo`,
+}, {
+	summary: "Mutate script must be valid",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					mutate: |
+						content.write("/file"
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid mutate script: mutate:2:1: got end of file, want '\)'`,
+}, {
+	summary: "Mutate script may only reference declared paths",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/etc/foo.conf: {text: foo, mutable: true}
+						/usr/share/foo/*:
+					mutate: |
+						data = content.read("/usr/share/foo/defaults")
+						content.write("/etc/foo.conf", data)
+				myslice2:
+					contents:
+						/etc/bar.conf: {text: bar, mutable: true}
+					mutate: |
+						content.write("/etc/foo.conf", "bar")
+		`,
+	},
+	relerror: `slice mypkg_myslice2 mutate script references undeclared path /etc/foo.conf`,
+}, {
+	summary: "Mutate script may reference paths from essential slices",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/etc/foo.conf: {text: foo, mutable: true}
+				myslice2:
+					essential:
+						- mypkg_myslice1
+					mutate: |
+						content.write("/etc/foo.conf", "bar")
+		`,
+	},
+}, {
+	summary: "Hardlinks are parsed",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/tool:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/usr/bin/tool":       {Kind: "copy"},
+							"/usr/bin/tool-alias": {Kind: "hardlink", Info: "/usr/bin/tool"},
+						},
+					},
+				},
+			},
+		},
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice"}},
+}, {
+	summary: "Hardlink target must be absolute",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/tool-alias: {hardlink: tool}
+		`,
+	},
+	relerror: `slice mypkg_myslice has invalid hardlink target for path /usr/bin/tool-alias: tool \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Hardlink cannot be a directory",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/dir/: {hardlink: /usr/bin/tool}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /usr/bin/dir/ must not end in / for 'hardlink' to be valid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Hardlink kind conflicts with other kinds",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool, text: foo}
+		`,
+	},
+	relerror: `slice mypkg_myslice path "/usr/bin/tool-alias": multiple content kinds specified \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Hardlinks to the same target do not conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/lib/tool/tool}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/tool/*:
+						/usr/bin/tool-alias: {hardlink: /usr/lib/tool/tool}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}},
+}, {
+	summary: "Hardlinks to different targets conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool1}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool2}
+		`,
+	},
+	relerror: `slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /usr/bin/tool-alias`,
+}, {
+	summary: "Hardlink target must be provided by the selection",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool}
+				myslice2:
+					contents:
+						/usr/bin/tool:
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice1"}},
+	selerror:  `slice mypkg_myslice1 path /usr/bin/tool-alias has hardlink target not provided by the selection: /usr/bin/tool`,
+}, {
+	summary: "Hardlink target must be a regular file",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/tool-alias: {hardlink: /usr/bin/tool}
+						/usr/bin/tool: {symlink: /usr/bin/other}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice"}},
+	selerror:  `slice mypkg_myslice path /usr/bin/tool-alias has hardlink target not provided by the selection: /usr/bin/tool`,
+}, {
+	summary: "Mode cannot be a bare decimal integer",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/x: {text: data, mode: 755}
+		`,
+	},
+	relerror: `slice mypkg_myslice path "/x": mode must be quoted octal or symbolic \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Mode must be a valid symbolic mode",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/x: {text: data, mode: "u+rwq"}
+		`,
+	},
+	relerror: `slice mypkg_myslice path "/x": invalid mode: "u\+rwq" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Mode must be within range",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/x: {text: data, mode: "017777"}
+		`,
+	},
+	relerror: `slice mypkg_myslice path "/x": invalid mode: "017777" \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Ownership is parsed",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/var/lib/daemon/: {make: true, uid: 100, gid: 101}
+						/var/lib/daemon/state: {text: data, uid: 100}
+						/usr/bin/daemon:
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/var/lib/daemon/":      {Kind: "dir", UID: 100, GID: 101},
+							"/var/lib/daemon/state": {Kind: "text", Info: "data", UID: 100},
+							"/usr/bin/daemon":       {Kind: "copy"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Ownership cannot be negative",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/var/lib/daemon/: {make: true, gid: -1}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /var/lib/daemon/ has negative uid or gid \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Same ownership does not conflict",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/var/lib/daemon/: {make: true, uid: 100, gid: 101}
+				myslice2:
+					contents:
+						/var/lib/daemon/: {make: true, uid: 100, gid: 101}
+		`,
+	},
+}, {
+	summary: "Different ownership conflicts",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/var/lib/daemon/: {make: true, uid: 100, gid: 101}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/var/lib/daemon/: {make: true, uid: 100}
+		`,
+	},
+	relerror: `slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /var/lib/daemon/: owner 100:101 != 100:0`,
+}, {
+	summary: "Symlink targets must be clean",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/tool: {symlink: /usr/./bin/tool}
+		`,
+	},
+	relerror: `slice mypkg_myslice has non-clean symlink target for path /bin/tool: /usr/./bin/tool`,
+}, {
+	summary: "Symlink targets may be cleaned when requested",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/bin/tool1: {symlink: /usr/./bin//tool}
+						/bin/tool2: {symlink: ../usr/lib/../bin/tool/, relative: true}
+		`,
+	},
+	relopts: &setup.ReadOptions{CleanSymlinks: true},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/bin/tool1": {Kind: "symlink", Info: "/usr/bin/tool"},
+							"/bin/tool2": {Kind: "symlink", Info: "../usr/bin/tool"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Content path errors include their location",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/foo:
+				myslice2:
+					essential:
+						- mypkg_myslice1
+					contents:
+						/bar:
+						  {text: data}
+						/baz/../:
+		`,
+	},
+	relerror: `slice mypkg_myslice2 has reserved name "\.\." in content path: /baz/\.\./ \(slices/mydir/mypkg.yaml:12:13\)`,
+}, {
+	summary: "Text matching its sha256",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {text: data, sha256: 3A6EB0790F39AC87C94F3856B2DD2C5D110E6811602261A9A923D3BB23ADC8B7}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path": {Kind: "text", Info: "data"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Text not matching its sha256",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {text: other, sha256: 3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /path has text with sha256 [0-9a-f]{64}, expected 3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7 \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Only text can have a sha256",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path: {copy: /other, sha256: 3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7}
+		`,
+	},
+	relerror: `slice mypkg_myslice path /path has sha256 but no text \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Text can be empty",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/nonempty: {text: "foo"}
+						/empty: {text: ""}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/nonempty": {Kind: "text", Info: "foo"},
+							"/empty":    {Kind: "text", Info: ""},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Text at the maximum number of lines",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {text: "one\ntwo\nthree\n"}
+						/path2: {text: "one\ntwo\nthree"}
+						/path3: {text: ""}
+		`,
+	},
+	relopts: &setup.ReadOptions{MaxTextLines: 3},
+}, {
+	summary: "Text over the maximum number of lines",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {text: "one\ntwo\nthree\n"}
+						/path2: {text: "one\ntwo\nthree\nfour"}
+		`,
+	},
+	relopts:  &setup.ReadOptions{MaxTextLines: 3},
+	relerror: `slice mypkg_myslice path /path2 has 4 lines of text, more than the maximum of 3`,
+}, {
+	summary: "Slice at the maximum number of content entries",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+						/usr/lib/**:
+				myslice2:
+					contents:
+						/etc/config: {text: data}
+		`,
+	},
+	relopts: &setup.ReadOptions{MaxContents: 2},
+}, {
+	summary: "Slice over the maximum number of content entries",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+						/usr/lib/**:
+						/etc/config: {text: data}
+		`,
+	},
+	relopts:  &setup.ReadOptions{MaxContents: 2},
+	relerror: `slice mypkg_myslice1 has 3 content entries, more than the maximum of 2`,
+}, {
+	summary: "Trailing whitespace is rejected when requested",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {text: "one\ntwo\n"}
+						/path2: {text: "one\ntwo \nthree\n"}
+		`,
+	},
+	relopts:  &setup.ReadOptions{NoTrailingSpace: true},
+	relerror: `slice mypkg_myslice path /path2 has trailing whitespace on line 2`,
+}, {
+	summary: "Text without trailing whitespace is accepted when requested",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path1: {text: "one\n\ttwo\n"}
+		`,
+	},
+	relopts: &setup.ReadOptions{NoTrailingSpace: true},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice": {
+						Package: "mypkg",
+						Name:    "myslice",
+						Contents: map[string]setup.PathInfo{
+							"/path1": {Kind: "text", Info: "one\n\ttwo\n"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Multiple archives",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main, universe]
+					suites: [jammy]
+					default: true
+				bar:
+					version: 22.04
+					components: [universe]
+					suites: [jammy-updates]
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "foo",
+
+		Archives: map[string]*setup.Archive{
+			"foo": {
+				Name:         "foo",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+			"bar": {
+				Name:         "bar",
+				Version:      "22.04",
+				Suites:       []string{"jammy-updates"},
+				Components:   []string{"universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "foo",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Archive components keep their declared order",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [universe, restricted, main]
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"universe", "restricted", "main"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Default archive falls back to the highest priority",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main]
+					priority: 10
+				bar:
+					version: 22.04
+					components: [main]
+					priority: 20
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "bar",
+
+		Archives: map[string]*setup.Archive{
+			"foo": {
+				Name:         "foo",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+				Priority:     10,
+			},
+			"bar": {
+				Name:         "bar",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+				Priority:     20,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "bar",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Default archive cannot be chosen among equal priorities",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main]
+				bar:
+					version: 22.04
+					components: [main]
+		`,
+	},
+	relerror: `chisel.yaml: archives "bar" and "foo" have the same priority and none is the default`,
+}, {
+	summary: "Default archive is the highest priority despite lower ties",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				a:
+					version: 22.04
+					components: [main]
+					priority: 1
+				b:
+					version: 22.04
+					components: [main]
+					priority: 1
+				c:
+					version: 22.04
+					components: [main]
+					priority: 5
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "c",
+
+		Archives: map[string]*setup.Archive{
+			"a": {
+				Name:         "a",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+				Priority:     1,
+			},
+			"b": {
+				Name:         "b",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+				Priority:     1,
+			},
+			"c": {
+				Name:         "c",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+				Priority:     5,
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "c",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Package names must be unique across directories",
+	input: map[string]string{
+		"slices/a/mypkg.yaml": `
+			package: mypkg
+		`,
+		"slices/b/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	relerror: `package mypkg defined in both slices/a/mypkg.yaml and slices/b/mypkg.yaml`,
+}, {
+	summary: "Packages may pin an archive",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main]
+					default: true
+				bar:
+					version: 22.04
+					components: [universe]
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			archive: bar
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "foo",
+
+		Archives: map[string]*setup.Archive{
+			"foo": {
+				Name:         "foo",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+			},
+			"bar": {
+				Name:         "bar",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "bar",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+				Pinned:  true,
+			},
+		},
+	},
+}, {
+	summary: "Essentials may come from compatible pinned archives",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main]
+					default: true
+				bar:
+					version: 22.04
+					components: [universe]
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice1
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			archive: bar
+			slices:
+				myslice1: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}},
+}, {
+	summary: "Essentials cannot come from incompatible pinned archives",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				foo:
+					version: 22.04
+					components: [main]
+					default: true
+				bar:
+					version: 20.04
+					components: [main]
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice1
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			archive: bar
+			slices:
+				myslice1: {}
+		`,
+	},
+	relerror: `slice mypkg1_myslice1 from archive "foo" \(ubuntu 22.04\) requires mypkg2_myslice1 from incompatible archive "bar" \(ubuntu 20.04\)`,
+}, {
+	summary: "Pinned archive must be defined",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			archive: x
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: package refers to undefined archive "x"`,
+}, {
+	summary: "Ubuntu archives do not need a URL for versions without a known suite",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: "24.04"
+					components: [main]
+					suites: [noble]
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "24.04",
+				Suites:       []string{"noble"},
+				Components:   []string{"main"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Archive URL must be an HTTP URL",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				debian:
+					version: "12"
+					components: [main]
+					suites: [bookworm]
+					url: ftp://deb.debian.org/debian/
+		`,
+	},
+	relerror: `chisel.yaml: archive "debian" has invalid url: "ftp://deb.debian.org/debian/"`,
+}, {
+	summary: "Debian archives must provide suites",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				debian:
+					version: "22.04"
+					components: [main]
+					distribution: debian
+					url: http://deb.debian.org/debian/
+		`,
+	},
+	relerror: `chisel.yaml: archive "debian" missing suites field`,
+}, {
+	summary: "Debian archives must provide a URL",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				debian:
+					version: "22.04"
+					components: [main]
+					suites: [bookworm]
+					distribution: debian
+		`,
+	},
+	relerror: `chisel.yaml: archive "debian" missing url field`,
+}, {
+	summary: "Archive distribution must be supported",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				fedora:
+					version: "38"
+					components: [main]
+					suites: [f38]
+					url: http://example.com/fedora/
+					distribution: fedora
+		`,
+	},
+	relerror: `chisel.yaml: archive "fedora" has unsupported distribution "fedora"`,
+}, {
+	summary: "Non-ubuntu archives with a URL",
+	input: map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				debian:
+					version: "12"
+					components: [main]
+					suites: [bookworm]
+					url: http://deb.debian.org/debian/
+					distribution: debian
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "debian",
+
+		Archives: map[string]*setup.Archive{
+			"debian": {
+				Name:         "debian",
+				Version:      "12",
+				Suites:       []string{"bookworm"},
+				Components:   []string{"main"},
+				Distribution: "debian",
+				URL:          "http://deb.debian.org/debian/",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "debian",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices:  map[string]*setup.Slice{},
+			},
+		},
+	},
+}, {
+	summary: "Architecture-specific slices are merged for the matching architecture",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/path1:
+				myslice2:
+					contents:
+						/path2:
+		`,
+		"slices/mydir/mypkg.amd64.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					essential:
+						- mypkg_myslice2
+					contents:
+						/path3: {text: amd64}
+				myslice3:
+					contents:
+						/path4:
+		`,
+		"slices/mydir/mypkg.arm64.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/path3: {text: arm64}
+		`,
+	},
+	relopts: &setup.ReadOptions{Arch: "amd64"},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package:   "mypkg",
+						Name:      "myslice1",
+						Essential: []setup.SliceKey{{"mypkg", "myslice2"}},
+						Contents: map[string]setup.PathInfo{
+							"/path1": {Kind: "copy"},
+							"/path3": {Kind: "text", Info: "amd64"},
+						},
+					},
+					"myslice2": {
+						Package: "mypkg",
+						Name:    "myslice2",
+						Contents: map[string]setup.PathInfo{
+							"/path2": {Kind: "copy"},
+						},
+					},
+					"myslice3": {
+						Package: "mypkg",
+						Name:    "myslice3",
+						Contents: map[string]setup.PathInfo{
+							"/path4": {Kind: "copy"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Architecture-specific slices are ignored for other architectures",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/path1:
+		`,
+		"slices/mydir/mypkg.amd64.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/path3: {text: amd64}
+				myslice3:
+					contents:
+						/path4:
+		`,
+	},
+	relopts: &setup.ReadOptions{Arch: "arm64"},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/path1": {Kind: "copy"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Architecture-specific slices are still validated",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+		"slices/mydir/mypkg.amd64.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/foo/../:
+		`,
+	},
+	relopts:  &setup.ReadOptions{Arch: "arm64"},
+	relerror: `slice mypkg_myslice1 has reserved name "\.\." in content path: /foo/../ \(slices/mydir/mypkg.amd64.yaml:5:13\)`,
+}, {
+	summary: "Architecture-specific slices need base definitions",
+	input: map[string]string{
+		"slices/mydir/mypkg.amd64.yaml": `
+			package: mypkg
+		`,
+	},
+	relerror: `slices/mydir/mypkg.amd64.yaml: package "mypkg" has no base slice definitions`,
+}, {
+	summary: "Architecture-specific slices must use a known architecture",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+		"slices/mydir/mypkg.amd46.yaml": `
+			package: mypkg
+		`,
+	},
+	relerror: `slices/mydir/mypkg.amd46.yaml: invalid architecture in filename: "amd46"`,
+}, {
+	summary: "Deprecated slices produce selection warnings",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					deprecated: use mypkg_myslice3
+				myslice2:
+					deprecated: {since: "1.3", message: use mypkg_myslice3}
+					essential:
+						- mypkg_myslice1
+				myslice3: {}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Deprecated: &setup.SliceDeprecation{
+							Message: "use mypkg_myslice3",
+						},
+					},
+					"myslice2": {
+						Package:   "mypkg",
+						Name:      "myslice2",
+						Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+						Deprecated: &setup.SliceDeprecation{
+							Since:   "1.3",
+							Message: "use mypkg_myslice3",
+						},
+					},
+					"myslice3": {
+						Package: "mypkg",
+						Name:    "myslice3",
+					},
+				},
+			},
+		},
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice2"}},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg",
+			Name:    "myslice1",
+			Deprecated: &setup.SliceDeprecation{
+				Message: "use mypkg_myslice3",
+			},
+		}, {
+			Package:   "mypkg",
+			Name:      "myslice2",
+			Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+			Deprecated: &setup.SliceDeprecation{
+				Since:   "1.3",
+				Message: "use mypkg_myslice3",
+			},
+		}},
+		Warnings: []string{
+			"slice mypkg_myslice1 is deprecated: use mypkg_myslice3",
+			"slice mypkg_myslice2 is deprecated since 1.3: use mypkg_myslice3",
+		},
+	},
+}, {
+	summary: "Experimental slices are not selected by default",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					experimental: true
+				myslice2:
+					essential:
+						- mypkg_myslice1
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package:      "mypkg",
+						Name:         "myslice1",
+						Experimental: true,
+					},
+					"myslice2": {
+						Package:   "mypkg",
+						Name:      "myslice2",
+						Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+					},
+				},
+			},
+		},
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice2"}},
+	selerror:  `cannot select experimental slice mypkg_myslice1 without allowing experimental slices`,
+}, {
+	summary: "Experimental slices are selected when allowed",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					experimental: true
+				myslice2:
+					essential:
+						- mypkg_myslice1
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice2"}},
+	selopts:   &setup.SelectOptions{AllowExperimental: true},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package:      "mypkg",
+			Name:         "myslice1",
+			Experimental: true,
+		}, {
+			Package:   "mypkg",
+			Name:      "myslice2",
+			Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+		}},
+	},
+}, {
+	summary: "Package max-total-files must not be negative",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			max-total-files: -1
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: invalid max-total-files: -1`,
+}, {
+	summary: "Slices cannot be defined more than once",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/path1:
+				myslice2: {}
+				myslice1:
+					contents:
+						/path2:
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: slice "myslice1" defined more than once`,
+}, {
+	summary: "Selection records why each slice was selected",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1: {}
+				myslice2:
+					essential:
+						- mypkg_myslice1
+				myslice3:
+					essential:
+						- mypkg_myslice2
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice3"}},
+	selopts:   &setup.SelectOptions{RecordReasons: true},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg",
+			Name:    "myslice1",
+		}, {
+			Package:   "mypkg",
+			Name:      "myslice2",
+			Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+		}, {
+			Package:   "mypkg",
+			Name:      "myslice3",
+			Essential: []setup.SliceKey{{"mypkg", "myslice2"}},
+		}},
+		Reasons: map[setup.SliceKey]setup.Reason{
+			{"mypkg", "myslice1"}: {RequiredBy: setup.SliceKey{"mypkg", "myslice2"}},
+			{"mypkg", "myslice2"}: {RequiredBy: setup.SliceKey{"mypkg", "myslice3"}},
+			{"mypkg", "myslice3"}: {Requested: true},
+		},
+	},
+}, {
+	summary: "Wildcard essentials expand to all package slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_*
+						- mypkg2_myslice2
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+				myslice2: {}
+				myslice3:
+					essential:
+						- mypkg2_*
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg1": {
+				Archive: "ubuntu",
+				Name:    "mypkg1",
+				Path:    "slices/mydir/mypkg1.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg1",
+						Name:    "myslice1",
+						Essential: []setup.SliceKey{
+							{"mypkg2", "myslice1"},
+							{"mypkg2", "myslice2"},
+							{"mypkg2", "myslice3"},
+						},
+					},
+				},
+			},
+			"mypkg2": {
+				Archive: "ubuntu",
+				Name:    "mypkg2",
+				Path:    "slices/mydir/mypkg2.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg2",
+						Name:    "myslice1",
+					},
+					"myslice2": {
+						Package: "mypkg2",
+						Name:    "myslice2",
+					},
+					"myslice3": {
+						Package: "mypkg2",
+						Name:    "myslice3",
+						Essential: []setup.SliceKey{
+							{"mypkg2", "myslice1"},
+							{"mypkg2", "myslice2"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Cycles are detected through wildcard essentials",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_*
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+				myslice2:
+					essential:
+						- mypkg1_myslice1
+		`,
+	},
+	relerror: `essential loop detected: mypkg1_myslice1, mypkg2_myslice2`,
+}, {
+	summary: "Wildcard essentials require a package with slices",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_*
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+		`,
+	},
+	relerror: `mypkg1_myslice1 requires mypkg2_\*, but package has no slices`,
+}, {
+	summary: "Package essentials are inherited by all slices",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			essential:
+				- mypkg_base
+			slices:
+				base: {}
+				myslice1: {}
+				myslice2:
+					essential:
+						- mypkg_myslice1
+				myslice3:
+					essential:
+						- mypkg_base
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"base": {
+						Package: "mypkg",
+						Name:    "base",
+					},
+					"myslice1": {
+						Package:   "mypkg",
+						Name:      "myslice1",
+						Essential: []setup.SliceKey{{"mypkg", "base"}},
+					},
+					"myslice2": {
+						Package:   "mypkg",
+						Name:      "myslice2",
+						Essential: []setup.SliceKey{{"mypkg", "base"}, {"mypkg", "myslice1"}},
+					},
+					"myslice3": {
+						Package:   "mypkg",
+						Name:      "myslice3",
+						Essential: []setup.SliceKey{{"mypkg", "base"}},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Cycles are detected through package essentials",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			essential:
+				- mypkg_base
+			slices:
+				base:
+					essential:
+						- mypkg_myslice1
+				myslice1: {}
+		`,
+	},
+	relerror: `essential loop detected: mypkg_base, mypkg_myslice1`,
+}, {
+	summary: "Selection is sorted with essentials first and ties broken by name",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice3
+				myslice2: {}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+				myslice3:
+					essential:
+						- mypkg2_myslice1
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg1",
+			Name:    "myslice2",
+		}, {
+			Package: "mypkg2",
+			Name:    "myslice1",
+		}, {
+			Package:   "mypkg2",
+			Name:      "myslice3",
+			Essential: []setup.SliceKey{{"mypkg2", "myslice1"}},
+		}, {
+			Package:   "mypkg1",
+			Name:      "myslice1",
+			Essential: []setup.SliceKey{{"mypkg2", "myslice3"}},
+		}},
+		Warnings: []string{"slice mypkg1_myslice2 has no contents and no essentials"},
+	},
+}, {
+	summary: "Slice definitions may include other files",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			include:
+				- mypkg-bins.yaml
+				- extra/libs.yml
+			slices:
+				myslice1:
+					contents:
+						/etc/foo.conf:
+		`,
+		"slices/mydir/mypkg-bins.yaml": `
+			slices:
+				bins:
+					essential:
+						- mypkg_myslice1
+					contents:
+						/usr/bin/foo:
+		`,
+		"slices/mydir/extra/libs.yml": `
+			slices:
+				libs:
+					contents:
+						/usr/lib/libfoo.so:
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/etc/foo.conf": {Kind: "copy"},
+						},
+					},
+					"bins": {
+						Package:   "mypkg",
+						Name:      "bins",
+						Essential: []setup.SliceKey{{"mypkg", "myslice1"}},
+						Contents: map[string]setup.PathInfo{
+							"/usr/bin/foo": {Kind: "copy"},
+						},
+					},
+					"libs": {
+						Package: "mypkg",
+						Name:    "libs",
+						Contents: map[string]setup.PathInfo{
+							"/usr/lib/libfoo.so": {Kind: "copy"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Included files are not held to package file names",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			include:
+				- mypkg_extra.yaml
+		`,
+		"slices/mydir/mypkg_extra.yaml": `
+			slices:
+				myslice1:
+					contents:
+						/etc/foo.conf:
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/etc/foo.conf": {Kind: "copy"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Files not included must be named after their package",
+	input: map[string]string{
+		"slices/mydir/mypkg_extra.yaml": `
+			package: mypkg
+		`,
+	},
+	relerror: `invalid slice definition filename: "mypkg_extra.yaml"\"\)`,
+}, {
+	summary: "Included slices cannot be defined more than once",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			include:
+				- mypkg-extra.yaml
+			slices:
+				myslice1: {}
+		`,
+		"slices/mydir/mypkg-extra.yaml": `
+			slices:
+				myslice1: {}
+		`,
+	},
+	relerror: `slice "myslice1" defined in both slices/mydir/mypkg.yaml and slices/mydir/mypkg-extra.yaml`,
+}, {
+	summary: "Included files must be within the release",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			include:
+				- ../../../other.yaml
+		`,
+	},
+	relerror: `slices/mydir/mypkg.yaml: include "../../../other.yaml" escapes the release directory`,
+}, {
+	summary: "Content errors in included files report their location",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			include:
+				- mypkg-extra.yaml
+		`,
+		"slices/mydir/mypkg-extra.yaml": `
+			slices:
+				myslice1:
+					contents:
+						/path//:
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has invalid content path: /path// \(slices/mydir/mypkg-extra.yaml:4:13\)`,
+}, {
+	summary: "Deprecation must have a message",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					deprecated: {since: "1.3"}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has empty deprecation message`,
+}, {
+	summary: "Deprecation mapping only accepts since and message",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					deprecated: {until: "1.3", message: gone}
+		`,
+	},
+	relerror: `cannot parse package "mypkg" slice definitions: deprecated must be a string or a mapping with since and message`,
+}, {
+	summary: "Substitutions replace slices in the selection",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_slow
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				slow: {}
+				fast:
+					essential:
+						- mypkg2_base
+				base: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}},
+	selopts: &setup.SelectOptions{
+		Substitutions: map[setup.SliceKey]setup.SliceKey{
+			{"mypkg2", "slow"}: {"mypkg2", "fast"},
+		},
+	},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg2",
+			Name:    "base",
+		}, {
+			Package:   "mypkg2",
+			Name:      "fast",
+			Essential: []setup.SliceKey{{"mypkg2", "base"}},
+		}, {
+			Package:   "mypkg1",
+			Name:      "myslice1",
+			Essential: []setup.SliceKey{{"mypkg2", "slow"}},
+		}},
+	},
+}, {
+	summary: "Empty slice warnings apply to substituted slices",
+	input: map[string]string{
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				slow: {}
+				fast:
+					contents:
+						/path:
+				full:
+					contents:
+						/other:
+				empty: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg2", "slow"}, {"mypkg2", "full"}},
+	selopts: &setup.SelectOptions{
+		Substitutions: map[setup.SliceKey]setup.SliceKey{
+			{"mypkg2", "slow"}: {"mypkg2", "fast"},
+			{"mypkg2", "full"}: {"mypkg2", "empty"},
+		},
+	},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg2",
+			Name:    "empty",
+		}, {
+			Package:  "mypkg2",
+			Name:     "fast",
+			Contents: map[string]setup.PathInfo{"/path": {Kind: "copy"}},
+		}},
+		Warnings: []string{"slice mypkg2_empty has no contents and no essentials"},
+	},
+}, {
+	summary: "Substitution target must exist",
+	input: map[string]string{
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				slow: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg2", "slow"}},
+	selopts: &setup.SelectOptions{
+		Substitutions: map[setup.SliceKey]setup.SliceKey{
+			{"mypkg2", "slow"}: {"mypkg2", "fast"},
+		},
+	},
+	selerror: `cannot substitute mypkg2_slow with mypkg2_fast: slice mypkg2_fast not found`,
+}, {
+	summary: "Substituted slice must exist",
+	input: map[string]string{
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				fast: {}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg2", "fast"}},
+	selopts: &setup.SelectOptions{
+		Substitutions: map[setup.SliceKey]setup.SliceKey{
+			{"mypkg2", "slow"}: {"mypkg2", "fast"},
+		},
+	},
+	selerror: `cannot substitute mypkg2_slow with mypkg2_fast: slice mypkg2_slow not found`,
+}, {
+	summary: "Glob patterns must use supported syntax",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/[/**:
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has invalid wildcard path /usr/\[/\*\*: unsupported character '\[' \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Glob patterns must not have more than two consecutive stars",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/***.so:
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has invalid wildcard path /usr/lib/\*\*\*.so: more than two consecutive '\*' \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Valid glob patterns are accepted",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/lib/**/lib?.so*:
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/usr/lib/**/lib?.so*": {Kind: "glob"},
+						},
+					},
+				},
+			},
+		},
+	},
+}, {
+	summary: "Empty slices are only reported when requested directly",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				empty1: {}
+				empty2: {}
+				myslice:
+					essential:
+						- mypkg_empty2
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg", "myslice"}, {"mypkg", "empty1"}},
+	selection: &setup.Selection{
+		Slices: []*setup.Slice{{
+			Package: "mypkg",
+			Name:    "empty1",
+		}, {
+			Package: "mypkg",
+			Name:    "empty2",
+		}, {
+			Package:   "mypkg",
+			Name:      "myslice",
+			Essential: []setup.SliceKey{{"mypkg", "empty2"}},
+		}},
+		Warnings: []string{"slice mypkg_empty1 has no contents and no essentials"},
+	},
+}, {
+	summary: "Paths declared up to the maximum number of times",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: data}
+						/usr/bin/tool:
+				myslice2:
+					contents:
+						/etc/config: {text: data}
+						/usr/bin/tool:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: data}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}, {"mypkg2", "myslice1"}},
+	selopts:   &setup.SelectOptions{MaxPathDeclarations: 3},
+}, {
+	summary: "Paths declared more than the maximum number of times",
+	input: map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: data}
+						/usr/bin/tool:
+				myslice2:
+					contents:
+						/etc/config: {text: data}
+						/usr/bin/tool:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: data}
+		`,
+	},
+	selslices: []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}, {"mypkg2", "myslice1"}},
+	selopts:   &setup.SelectOptions{MaxPathDeclarations: 2},
+	selerror:  `path /etc/config is declared by 3 slices, more than the maximum of 2`,
+}, {
+	summary: "Copy source must be clean",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/etc/passwd: {copy: /a/../../etc/passwd}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has invalid copy source for path /etc/passwd: /a/../../etc/passwd \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Copy source must be absolute",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/etc/passwd: {copy: etc/passwd}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has invalid copy source for path /etc/passwd: etc/passwd \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Symlink target must not escape the root",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/bin/passwd: {symlink: ../../etc/passwd, relative: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has symlink escaping the root for path /bin/passwd: ../../etc/passwd \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Symlink target must be absolute",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/bin/foo: {symlink: ../usr/bin/foo}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 path "/bin/foo": symlink target must be absolute \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Relative is only valid for symlinks",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/bin/foo: {text: data, relative: true}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 path /bin/foo has relative but no symlink \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Absolute symlink target must not escape the root",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/bin/passwd: {symlink: /a/../../etc/passwd}
+		`,
+	},
+	relerror: `slice mypkg_myslice1 has symlink escaping the root for path /bin/passwd: /a/../../etc/passwd \(slices/mydir/mypkg.yaml:5:13\)`,
+}, {
+	summary: "Clean copy sources and contained symlink targets are accepted",
+	input: map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/etc/passwd: {copy: /usr/share/base-passwd/passwd.master}
+						/bin/passwd: {symlink: ../usr/bin/passwd, relative: true}
+		`,
+	},
+	release: &setup.Release{
+		DefaultArchive: "ubuntu",
+
+		Archives: map[string]*setup.Archive{
+			"ubuntu": {
+				Name:         "ubuntu",
+				Version:      "22.04",
+				Suites:       []string{"jammy"},
+				Components:   []string{"main", "universe"},
+				Distribution: "ubuntu",
+			},
+		},
+		Packages: map[string]*setup.Package{
+			"mypkg": {
+				Archive: "ubuntu",
+				Name:    "mypkg",
+				Path:    "slices/mydir/mypkg.yaml",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/etc/passwd": {Kind: "copy", Info: "/usr/share/base-passwd/passwd.master"},
+							"/bin/passwd": {Kind: "symlink", Info: "../usr/bin/passwd"},
+						},
+					},
+				},
+			},
+		},
+	},
+}}
+
+const defaultChiselYaml = `
+	format: chisel-v1
+	archives:
+		ubuntu:
+			version: 22.04
+			components: [main, universe]
+`
+
+func (s *S) TestParseRelease(c *C) {
+	for _, test := range setupTests {
+		c.Logf("Summary: %s", test.summary)
+
+		if _, ok := test.input["chisel.yaml"]; !ok {
+			test.input["chisel.yaml"] = string(defaultChiselYaml)
+		}
+
+		dir := writeRelease(c, test.input)
+
+		release, err := setup.ReadReleaseWithOptions(dir, test.relopts)
+		if err != nil || test.relerror != "" {
+			if test.relerror != "" {
+				c.Assert(err, ErrorMatches, test.relerror)
+				continue
+			} else {
+				c.Assert(err, IsNil)
+			}
+		}
+
+		c.Assert(release.Path, Equals, dir)
+		release.Path = ""
+
+		if test.release != nil {
+			c.Assert(release, DeepEquals, test.release)
+		}
+
+		if test.selslices != nil {
+			selection, err := setup.SelectWithOptions(release, test.selslices, test.selopts)
+			if test.selerror != "" {
+				c.Assert(err, ErrorMatches, test.selerror)
+				continue
+			} else {
 				c.Assert(err, IsNil)
 			}
 			c.Assert(selection.Release, Equals, release)
@@ -853,3 +3843,1863 @@ func (s *S) TestParseRelease(c *C) {
 		}
 	}
 }
+
+func writeRelease(c *C, input map[string]string) string {
+	dir := c.MkDir()
+	for path, data := range input {
+		fpath := filepath.Join(dir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+	return dir
+}
+
+func readRelease(c *C, input map[string]string) *setup.Release {
+	if _, ok := input["chisel.yaml"]; !ok {
+		input["chisel.yaml"] = string(defaultChiselYaml)
+	}
+	release, err := setup.ReadRelease(writeRelease(c, input))
+	c.Assert(err, IsNil)
+	return release
+}
+
+func (s *S) TestUnusedPackages(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg2_myslice1]}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1: {}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.UnusedPackages(), DeepEquals, []string{"mypkg3"})
+
+	selection, err = setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.UnusedPackages(), DeepEquals, []string{"mypkg2", "mypkg3"})
+}
+
+func (s *S) TestClosureSize(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+				myslice2: {essential: [mypkg1_myslice1, mypkg2_myslice1]}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {essential: [mypkg1_myslice1]}
+				myslice2: {}
+		`,
+	})
+
+	keys := []setup.SliceKey{{"mypkg1", "myslice2"}, {"mypkg2", "myslice2"}}
+	size, err := release.ClosureSize(keys)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, 4)
+
+	selection, err := setup.Select(release, keys)
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, len(selection.Slices))
+
+	size, err = release.ClosureSize([]setup.SliceKey{{"mypkg2", "myslice1"}})
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, 2)
+
+	_, err = release.ClosureSize([]setup.SliceKey{{"mypkg2", "myslice3"}})
+	c.Assert(err, ErrorMatches, "slice mypkg2_myslice3 not found")
+}
+
+func (s *S) TestDuplicateSlices(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {text: same}
+						/path2: {symlink: /link}
+				myslice2:
+					contents:
+						/path3: {text: other}
+				myslice3: {}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential: [mypkg1_myslice2]
+					contents:
+						/path1: {text: same}
+						/path2: {symlink: /link}
+				myslice2:
+					contents:
+						/path1: {text: same}
+				myslice3: {}
+		`,
+	})
+
+	c.Assert(release.DuplicateSlices(), DeepEquals, [][]setup.SliceKey{
+		{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}},
+	})
+}
+
+func (s *S) TestAppendedText(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path1: {text: {append: "one "}}
+						/path2: {text: "plain"}
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+					contents:
+						/path1: {text: {append: "three"}}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential:
+						- mypkg1_myslice1
+					contents:
+						/path1: {text: {append: "two "}}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+
+	text, ok := selection.AppendedText("/path1")
+	c.Assert(ok, Equals, true)
+	c.Assert(text, Equals, "one two three")
+
+	_, ok = selection.AppendedText("/path2")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestRequiredDirs(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/ssl/certs/ca.pem:
+						/usr/lib/foo/**:
+						/usr/lib/*/bar.so:
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+					contents:
+						/var/lib/mydir/: {make: true}
+						/etc/ssl/openssl.cnf: {text: data}
+						/file:
+				myslice3:
+					contents:
+						/opt/other/:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool: {symlink: /usr/lib/tool}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.RequiredDirs(), DeepEquals, []string{
+		"/etc/",
+		"/etc/ssl/",
+		"/etc/ssl/certs/",
+		"/usr/",
+		"/usr/bin/",
+		"/usr/lib/",
+		"/usr/lib/foo/",
+		"/var/",
+		"/var/lib/",
+		"/var/lib/mydir/",
+	})
+}
+
+func (s *S) TestReplaced(c *C) {
+	release := readRelease(c, map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main, universe]
+			replaces:
+				/etc/: mypkg2
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: one}
+						/etc/other: {text: one}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/config: {text: two}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}})
+	c.Assert(err, IsNil)
+	slice1 := release.Packages["mypkg1"].Slices["myslice1"]
+	slice2 := release.Packages["mypkg2"].Slices["myslice1"]
+	c.Assert(selection.Replaced(slice1, "/etc/config"), Equals, true)
+	c.Assert(selection.Replaced(slice1, "/etc/other"), Equals, false)
+	c.Assert(selection.Replaced(slice2, "/etc/config"), Equals, false)
+
+	selection, err = setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.Replaced(slice1, "/etc/config"), Equals, false)
+}
+
+func (s *S) TestFindSlices(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/mypkg1.conf:
+				myslice2:
+					contents:
+						/usr/bin/mypkg1:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice2:
+					contents:
+						/etc/mypkg2/: {make: true}
+				myslice1:
+					contents:
+						/etc/mypkg2.conf:
+						/usr/bin/mypkg2:
+		`,
+	})
+
+	found := release.FindSlices(func(slice *setup.Slice) bool {
+		for path := range slice.Contents {
+			if strings.HasPrefix(path, "/etc/") {
+				return true
+			}
+		}
+		return false
+	})
+	var names []string
+	for _, slice := range found {
+		names = append(names, slice.String())
+	}
+	c.Assert(names, DeepEquals, []string{"mypkg1_myslice1", "mypkg2_myslice1", "mypkg2_myslice2"})
+
+	found = release.FindSlices(func(*setup.Slice) bool { return false })
+	c.Assert(found, HasLen, 0)
+}
+
+func (s *S) TestMaxDependencyDepth(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice1
+				myslice2:
+					essential:
+						- mypkg3_myslice1
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential:
+						- mypkg3_myslice1
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1: {}
+				myslice2: {}
+		`,
+	})
+
+	depth, chain := release.MaxDependencyDepth()
+	c.Assert(depth, Equals, 3)
+	c.Assert(chain, DeepEquals, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg2", "myslice1"},
+		{"mypkg3", "myslice1"},
+	})
+
+	release = readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+		`,
+	})
+	depth, chain = release.MaxDependencyDepth()
+	c.Assert(depth, Equals, 0)
+	c.Assert(chain, IsNil)
+}
+
+func (s *S) TestPackageDependencies(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg1_myslice2
+						- mypkg3_myslice1
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+						- mypkg3_myslice2
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential:
+						- mypkg3_myslice1
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1: {}
+				myslice2:
+					essential:
+						- mypkg3_myslice1
+		`,
+	})
+
+	c.Assert(release.PackageDependencies(), DeepEquals, map[string][]string{
+		"mypkg1": {"mypkg2", "mypkg3"},
+		"mypkg2": {"mypkg3"},
+	})
+}
+
+func (s *S) TestTextContents(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/hostname: {text: localhost}
+						/etc/motd: {text: ""}
+						/usr/bin/tool:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/issue: {text: {append: "Welcome\n"}}
+		`,
+	})
+
+	c.Assert(release.TextContents(), DeepEquals, []setup.TextRef{
+		{Slice: setup.SliceKey{"mypkg1", "myslice1"}, Path: "/etc/hostname", Size: 9},
+		{Slice: setup.SliceKey{"mypkg1", "myslice1"}, Path: "/etc/motd", Size: 0},
+		{Slice: setup.SliceKey{"mypkg2", "myslice1"}, Path: "/etc/issue", Size: 8},
+	})
+}
+
+func (s *S) TestAllDirs(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/var/lib/foo/: {make: true}
+						/etc/foo.d/: {make: true, mode: 0700}
+						/usr/share/foo/:
+				myslice2:
+					contents:
+						/var/lib/foo/: {make: true}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/run/bar/: {make: true, mode: 01777}
+		`,
+	})
+
+	c.Assert(release.AllDirs(), DeepEquals, []setup.PathRef{
+		{Slice: setup.SliceKey{"mypkg1", "myslice1"}, Path: "/etc/foo.d/", Mode: 0700},
+		{Slice: setup.SliceKey{"mypkg1", "myslice1"}, Path: "/var/lib/foo/", Mode: 0755},
+		{Slice: setup.SliceKey{"mypkg1", "myslice2"}, Path: "/var/lib/foo/", Mode: 0755},
+		{Slice: setup.SliceKey{"mypkg2", "myslice1"}, Path: "/run/bar/", Mode: 01777},
+	})
+}
+
+func (s *S) TestGraphDOT(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice2
+						- mypkg1_myslice2
+				myslice2: {}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+		`,
+	})
+
+	dot := release.GraphDOT()
+	c.Assert(dot, Equals, `digraph slices {
+	"mypkg1_myslice1";
+	"mypkg1_myslice2";
+	"mypkg2_myslice1";
+	"mypkg2_myslice2";
+	"mypkg1_myslice1" -> "mypkg1_myslice2";
+	"mypkg1_myslice1" -> "mypkg2_myslice2";
+	"mypkg2_myslice2" -> "mypkg2_myslice1";
+}
+`)
+	for i := 0; i < 10; i++ {
+		c.Assert(release.GraphDOT(), Equals, dot)
+	}
+}
+
+func (s *S) TestReachableFrom(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice1
+				myslice2:
+					essential:
+						- mypkg3_myslice2
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential:
+						- mypkg3_myslice1
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1: {}
+				myslice2: {}
+		`,
+	})
+
+	keys, err := release.ReachableFrom(setup.SliceKey{"mypkg1", "myslice1"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg2", "myslice1"},
+		{"mypkg3", "myslice1"},
+	})
+
+	keys, err = release.ReachableFrom(setup.SliceKey{"mypkg3", "myslice2"})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []setup.SliceKey{{"mypkg3", "myslice2"}})
+
+	_, err = release.ReachableFrom(setup.SliceKey{"mypkg3", "myslice3"})
+	c.Assert(err, ErrorMatches, `slice mypkg3_myslice3 not found`)
+}
+
+func (s *S) TestUniqueClosure(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					essential:
+						- mypkg2_myslice1
+						- mypkg3_myslice1
+				myslice2:
+					essential:
+						- mypkg3_myslice1
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1: {}
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1:
+					essential:
+						- mypkg3_myslice2
+				myslice2: {}
+		`,
+	})
+
+	keys, err := release.UniqueClosure(setup.SliceKey{"mypkg1", "myslice1"}, []setup.SliceKey{{"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg2", "myslice1"},
+	})
+
+	keys, err = release.UniqueClosure(setup.SliceKey{"mypkg1", "myslice1"}, nil)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 4)
+
+	keys, err = release.UniqueClosure(setup.SliceKey{"mypkg3", "myslice1"}, []setup.SliceKey{{"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+
+	_, err = release.UniqueClosure(setup.SliceKey{"mypkg1", "myslice1"}, []setup.SliceKey{{"mypkg3", "myslice3"}})
+	c.Assert(err, ErrorMatches, `slice mypkg3_myslice3 not found`)
+}
+
+type fileLister map[string][]string
+
+func (l fileLister) Files(pkg string) []string {
+	return l[pkg]
+}
+
+func (s *S) TestActiveSlices(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				bins:
+					contents:
+						/usr/bin/tool:
+				libs:
+					contents:
+						/usr/lib/**/libtool.so*:
+				config:
+					contents:
+						/etc/tool.conf: {copy: /usr/share/tool/tool.conf}
+				docs:
+					contents:
+						/usr/share/doc/tool/:
+				extra:
+					contents:
+						/usr/bin/missing:
+						/etc/generated: {text: data}
+						/bin/tool: {symlink: /usr/bin/tool}
+				made:
+					contents:
+						/usr/bin/: {make: true}
+		`,
+	})
+
+	lister := fileLister{"mypkg": {
+		"/usr/",
+		"/usr/bin/",
+		"/usr/bin/tool",
+		"/usr/lib/x86_64-linux-gnu/libtool.so.1",
+		"/usr/share/tool/tool.conf",
+		"/etc/generated",
+		"/bin/tool",
+	}}
+	c.Assert(release.Packages["mypkg"].ActiveSlices(lister), DeepEquals, []string{"bins", "config", "libs"})
+	c.Assert(release.Packages["mypkg"].ActiveSlices(fileLister{}), IsNil)
+}
+
+func (s *S) TestCheckTotalFiles(c *C) {
+	input := map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			max-total-files: 4
+			slices:
+				bins:
+					contents:
+						/usr/bin/tool:
+				libs:
+					contents:
+						/usr/lib/**/libtool.so*:
+				config:
+					contents:
+						/usr/bin/tool:
+						/etc/tool.conf: {text: data}
+		`,
+	}
+	dir := writeRelease(c, input)
+
+	within := fileLister{"mypkg": {
+		"/usr/bin/tool",
+		"/usr/lib/x86_64-linux-gnu/libtool.so.1",
+		"/usr/lib/x86_64-linux-gnu/libtool.so.1.0",
+	}}
+	release, err := setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{Provider: within})
+	c.Assert(err, IsNil)
+	c.Assert(release.Packages["mypkg"].MaxTotalFiles, Equals, 4)
+	c.Assert(release.Packages["mypkg"].TotalFiles(within), Equals, 4)
+
+	over := fileLister{"mypkg": append(within["mypkg"], "/usr/lib/x86_64-linux-gnu/libtool.so")}
+	_, err = setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{Provider: over})
+	c.Assert(err, ErrorMatches, `package mypkg slices have 5 files, more than the maximum of 4`)
+
+	// Without a provider the budget is not checked.
+	_, err = setup.ReadReleaseWithOptions(dir, nil)
+	c.Assert(err, IsNil)
+}
+
+func (s *S) TestReadReleaseFS(c *C) {
+	input := map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/path:
+		`,
+	}
+	fsys := fstest.MapFS{}
+	for path, data := range input {
+		fsys[path] = &fstest.MapFile{Data: testutil.Reindent(data)}
+	}
+
+	release, err := setup.ReadReleaseFS(fsys)
+	c.Assert(err, IsNil)
+	c.Assert(release.Path, Equals, "")
+
+	expected, err := setup.ReadRelease(writeRelease(c, input))
+	c.Assert(err, IsNil)
+	expected.Path = ""
+	c.Assert(release, DeepEquals, expected)
+
+	delete(fsys, "slices/mydir/mypkg.yaml")
+	_, err = setup.ReadReleaseFS(fsys)
+	c.Assert(err, ErrorMatches, `cannot read slices/ directory`)
+
+	delete(fsys, "chisel.yaml")
+	_, err = setup.ReadReleaseFS(fsys)
+	c.Assert(err, ErrorMatches, `cannot read release definition: open chisel.yaml: file does not exist`)
+}
+
+func (s *S) TestReadReleaseFSLimits(c *C) {
+	fsys := fstest.MapFS{
+		"chisel.yaml": &fstest.MapFile{Data: testutil.Reindent(defaultChiselYaml)},
+	}
+	for _, pkg := range []string{"mypkg1", "mypkg2", "mypkg3"} {
+		fsys["slices/mydir/"+pkg+".yaml"] = &fstest.MapFile{Data: []byte("package: " + pkg + "\n")}
+	}
+	var total int64
+	for _, file := range fsys {
+		total += int64(len(file.Data))
+	}
+
+	_, err := setup.ReadReleaseFSWithOptions(fsys, &setup.ReadOptions{MaxFiles: 4, MaxTotalBytes: total})
+	c.Assert(err, IsNil)
+
+	_, err = setup.ReadReleaseFSWithOptions(fsys, &setup.ReadOptions{MaxFiles: 3})
+	c.Assert(err, ErrorMatches, `cannot read slice definition file: release has more than 3 files`)
+
+	_, err = setup.ReadReleaseFSWithOptions(fsys, &setup.ReadOptions{MaxTotalBytes: total - 1})
+	c.Assert(err, ErrorMatches, fmt.Sprintf(`cannot read slice definition file: release has more than %d bytes`, total-1))
+
+	_, err = setup.ReadReleaseFSWithOptions(fsys, &setup.ReadOptions{MaxTotalBytes: 10})
+	c.Assert(err, ErrorMatches, `cannot read release definition: release has more than 10 bytes`)
+}
+
+var contentKindConflictTests = []struct {
+	path  string
+	attrs string
+	error string
+}{
+	{"/x", "copy: /a, symlink: /b", `slice mypkg_myslice path "/x": multiple content kinds specified`},
+	{"/x", "copy: /a, text: c", `slice mypkg_myslice path "/x": multiple content kinds specified`},
+	{"/x", "symlink: /b, text: c", `slice mypkg_myslice path "/x": multiple content kinds specified`},
+	{"/x", "copy: /a, symlink: /b, text: c", `slice mypkg_myslice path "/x": multiple content kinds specified`},
+	{"/x", "hardlink: /a, copy: /b", `slice mypkg_myslice path "/x": multiple content kinds specified`},
+	{"/x/", "make: true, copy: /a", `slice mypkg_myslice path "/x/": multiple content kinds specified`},
+	{"/x/", "make: true, text: c", `slice mypkg_myslice path "/x/": multiple content kinds specified`},
+	{"/x/", "make: true, symlink: /b", `slice mypkg_myslice path "/x/": multiple content kinds specified`},
+	{"/x", "symlink: /b, mutable: true", `slice mypkg_myslice mutable is not a regular file: /x`},
+	{"/x/", "make: true, mutable: true", `slice mypkg_myslice mutable is not a regular file: /x/`},
+	{"/x/", "mutable: true", `slice mypkg_myslice mutable is not a regular file: /x/`},
+}
+
+func (s *S) TestContentKindConflicts(c *C) {
+	for _, test := range contentKindConflictTests {
+		c.Logf("Attributes: %s", test.attrs)
+		dir := writeRelease(c, map[string]string{
+			"chisel.yaml": string(defaultChiselYaml),
+			"slices/mydir/mypkg.yaml": fmt.Sprintf(`
+				package: mypkg
+				slices:
+					myslice:
+						contents:
+							%s: {%s}
+			`, test.path, test.attrs),
+		})
+		_, err := setup.ReadRelease(dir)
+		c.Assert(err, ErrorMatches, test.error+` \(slices/mydir/mypkg.yaml:5:13\)`)
+	}
+}
+
+func (s *S) TestLoadAndSelect(c *C) {
+	dir := writeRelease(c, map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+				myslice2:
+					essential:
+						- mypkg_myslice1
+					contents:
+						/etc/config: {text: "one\ntwo\n"}
+		`,
+	})
+	keys := []setup.SliceKey{{"mypkg", "myslice2"}}
+
+	release, err := setup.ReadRelease(dir)
+	c.Assert(err, IsNil)
+	expected, err := setup.Select(release, keys)
+	c.Assert(err, IsNil)
+
+	selection, err := setup.LoadAndSelect(dir, keys, nil)
+	c.Assert(err, IsNil)
+	c.Assert(selection.Slices, DeepEquals, expected.Slices)
+	c.Assert(selection.Release, DeepEquals, expected.Release)
+
+	_, err = setup.LoadAndSelect(dir, keys, &setup.LoadOptions{
+		ReadOptions: setup.ReadOptions{MaxTextLines: 1},
+	})
+	c.Assert(err, ErrorMatches, `slice mypkg_myslice2 path /etc/config has 2 lines of text, more than the maximum of 1`)
+
+	_, err = setup.LoadAndSelect(dir, keys, &setup.LoadOptions{
+		SelectOptions: setup.SelectOptions{MaxSlices: 1},
+	})
+	c.Assert(err, ErrorMatches, `selection has 2 slices, more than the maximum of 1`)
+}
+
+func (s *S) TestShadowedPaths(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/**:
+						/usr/bin/tool1:
+						/usr/bin/tool2: {mode: 0755}
+						/usr/bin/tool3: {arch: amd64}
+						/usr/bin/tool4: {copy: /usr/bin/tool1}
+						/usr/lib/tool:
+				myslice2:
+					contents:
+						/usr/bin/other:
+		`,
+	})
+
+	c.Assert(release.ShadowedPaths(), DeepEquals, []string{
+		"slice mypkg1_myslice1 path /usr/bin/tool1 is redundant with /usr/bin/**",
+	})
+}
+
+func (s *S) TestCollectErrors(c *C) {
+	dir := writeRelease(c, map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path//:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			archive: foo
+		`,
+		"slices/other/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1:
+					essential:
+						- mypkg3_MySlice
+		`,
+		"slices/other/mypkg4.yaml": `
+			package: mypkg4
+			slices:
+				myslice1:
+					contents:
+						/path:
+		`,
+	})
+
+	_, err := setup.ReadRelease(dir)
+	c.Assert(err, ErrorMatches, `slice mypkg1_myslice1 has invalid content path: /path// \(slices/mydir/mypkg1.yaml:5:13\)`)
+
+	_, err = setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{CollectErrors: true})
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, ""+
+		"slices/mydir/mypkg1.yaml: slice mypkg1_myslice1 has invalid content path: /path// (slices/mydir/mypkg1.yaml:5:13)\n"+
+		"slices/mydir/mypkg2.yaml: package refers to undefined archive \"foo\"\n"+
+		"slices/other/mypkg3.yaml: invalid slice reference \"mypkg3_MySlice\" in slices/other/mypkg3.yaml")
+}
+
+func (s *S) TestCollectReleaseErrors(c *C) {
+	dir := writeRelease(c, map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path//:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/path:
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice1:
+					contents:
+						/path:
+				myslice2:
+					essential:
+						- mypkg3_myslice3
+					contents:
+						/other: {text: data, mode: 0644}
+		`,
+	})
+
+	_, err := setup.ReadRelease(dir)
+	c.Assert(err, ErrorMatches, `slice mypkg1_myslice1 has invalid content path: /path// \(slices/mydir/mypkg1.yaml:5:13\)`)
+
+	_, err = setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{CollectErrors: true})
+	c.Assert(err, NotNil)
+	c.Assert(err.Error(), Equals, ""+
+		"mypkg3_myslice2 requires mypkg3_myslice3, but slice is missing\n"+
+		"slices mypkg2_myslice1 and mypkg3_myslice1 conflict on /path\n"+
+		"slices/mydir/mypkg1.yaml: slice mypkg1_myslice1 has invalid content path: /path// (slices/mydir/mypkg1.yaml:5:13)")
+}
+
+func (s *S) TestEndOfLifeWarnings(c *C) {
+	dir := writeRelease(c, map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				ubuntu:
+					version: 22.04
+					components: [main]
+					default: true
+				old:
+					version: 20.04
+					components: [main]
+				debian:
+					version: 18.04
+					distribution: debian
+					suites: [stretch]
+					url: http://deb.debian.org/debian
+					components: [main]
+		`,
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	})
+
+	release, err := setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{WarnEndOfLife: true})
+	c.Assert(err, IsNil)
+	c.Assert(release.Warnings, DeepEquals, []string{
+		`archive "old" uses end-of-life Ubuntu version 20.04`,
+	})
+
+	release, err = setup.ReadRelease(dir)
+	c.Assert(err, IsNil)
+	c.Assert(release.Warnings, IsNil)
+}
+
+func (s *S) TestEndOfLifeWarningsSupported(c *C) {
+	dir := writeRelease(c, map[string]string{
+		"chisel.yaml": string(defaultChiselYaml),
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+		`,
+	})
+
+	release, err := setup.ReadReleaseWithOptions(dir, &setup.ReadOptions{WarnEndOfLife: true})
+	c.Assert(err, IsNil)
+	c.Assert(release.Warnings, IsNil)
+}
+
+var selectConflictTests = []struct {
+	summary string
+	info1   setup.PathInfo
+	info2   setup.PathInfo
+}{{
+	summary: "Text",
+	info1:   setup.PathInfo{Kind: "text", Info: "one"},
+	info2:   setup.PathInfo{Kind: "text", Info: "two"},
+}, {
+	summary: "Mode",
+	info1:   setup.PathInfo{Kind: "text", Info: "same", Mode: 0600},
+	info2:   setup.PathInfo{Kind: "text", Info: "same", Mode: 0644},
+}, {
+	summary: "Symlink target",
+	info1:   setup.PathInfo{Kind: "symlink", Info: "/link1"},
+	info2:   setup.PathInfo{Kind: "symlink", Info: "/link2"},
+}, {
+	summary: "Mutable",
+	info1:   setup.PathInfo{Kind: "text", Info: "same", Mutable: true},
+	info2:   setup.PathInfo{Kind: "text", Info: "same"},
+}, {
+	summary: "Kind",
+	info1:   setup.PathInfo{Kind: "text", Info: "/link"},
+	info2:   setup.PathInfo{Kind: "symlink", Info: "/link"},
+}}
+
+func (s *S) TestSelectPartialOnError(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/path: {text: one}
+				myslice2:
+					essential:
+						- mypkg1_myslice1
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/path: {text: one}
+		`,
+	})
+	release.Packages["mypkg2"].Slices["myslice1"].Contents["/path"] = setup.PathInfo{Kind: setup.TextPath, Info: "two"}
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice2"}, {"mypkg2", "myslice1"}})
+	c.Assert(err, ErrorMatches, `slices mypkg1_myslice1 and mypkg2_myslice1 conflict on /path`)
+	c.Assert(selection, NotNil)
+	c.Assert(selection.Release, Equals, release)
+	var names []string
+	for _, slice := range selection.Slices {
+		names = append(names, slice.String())
+	}
+	c.Assert(names, DeepEquals, []string{"mypkg1_myslice1", "mypkg1_myslice2", "mypkg2_myslice1"})
+
+	// Errors found before the slices are known leave no selection.
+	selection, err = setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice3"}})
+	c.Assert(err, ErrorMatches, `slice mypkg1_myslice3 not found`)
+	c.Assert(selection, IsNil)
+}
+
+func (s *S) TestSelectConflicts(c *C) {
+	for _, test := range selectConflictTests {
+		c.Logf("Summary: %s", test.summary)
+		release := &setup.Release{
+			Packages: map[string]*setup.Package{
+				"mypkg": {
+					Name: "mypkg",
+					Slices: map[string]*setup.Slice{
+						"myslice1": {
+							Package:  "mypkg",
+							Name:     "myslice1",
+							Contents: map[string]setup.PathInfo{"/path": test.info1},
+						},
+						"myslice2": {
+							Package:  "mypkg",
+							Name:     "myslice2",
+							Contents: map[string]setup.PathInfo{"/path": test.info2},
+						},
+					},
+				},
+			},
+		}
+		_, err := setup.Select(release, []setup.SliceKey{{"mypkg", "myslice1"}})
+		c.Assert(err, IsNil)
+		_, err = setup.Select(release, []setup.SliceKey{{"mypkg", "myslice1"}, {"mypkg", "myslice2"}})
+		c.Assert(err, ErrorMatches, "slices mypkg_myslice1 and mypkg_myslice2 conflict on /path")
+	}
+}
+
+var validateTests = []struct {
+	summary    string
+	contents   map[string]setup.PathInfo
+	essential1 []setup.SliceKey
+	essential2 []setup.SliceKey
+	archive    string
+	error      string
+}{{
+	summary: "Valid release",
+	contents: map[string]setup.PathInfo{
+		"/dir/":      {Kind: setup.DirPath, Mode: 0755},
+		"/dir/file":  {Kind: setup.TextPath, Info: "data"},
+		"/dir/link":  {Kind: setup.SymlinkPath, Info: "file"},
+		"/lib/":      {Kind: setup.CopyPath},
+		"/lib/**":    {Kind: setup.GlobPath},
+		"/usr/bin/a": {Kind: setup.CopyPath, Info: "/usr/bin/b"},
+	},
+	essential1: []setup.SliceKey{{"mypkg", "myslice2"}},
+}, {
+	summary:  "Content paths must be clean",
+	contents: map[string]setup.PathInfo{"/dir//file": {Kind: setup.CopyPath}},
+	error:    `slice mypkg_myslice1 has invalid content path: /dir//file`,
+}, {
+	summary:  "Content paths must be absolute",
+	contents: map[string]setup.PathInfo{"dir/file": {Kind: setup.CopyPath}},
+	error:    `slice mypkg_myslice1 has invalid content path: dir/file`,
+}, {
+	summary:  "Directories must be suffixed with /",
+	contents: map[string]setup.PathInfo{"/dir": {Kind: setup.DirPath}},
+	error:    `slice mypkg_myslice1 path /dir must end in / for 'make' to be valid`,
+}, {
+	summary:  "Text must not be suffixed with /",
+	contents: map[string]setup.PathInfo{"/dir/": {Kind: setup.TextPath}},
+	error:    `slice mypkg_myslice1 path /dir/ must not end in / for 'text' to be valid`,
+}, {
+	summary:  "Copies with a source must not be suffixed with /",
+	contents: map[string]setup.PathInfo{"/dir/": {Kind: setup.CopyPath, Info: "/other"}},
+	error:    `slice mypkg_myslice1 path /dir/ must not end in / for 'copy' to be valid`,
+}, {
+	summary:    "Missing slice dependency",
+	essential1: []setup.SliceKey{{"mypkg", "myslice3"}},
+	error:      `mypkg_myslice1 requires mypkg_myslice3, but slice is missing`,
+}, {
+	summary:    "Cycles are detected",
+	essential1: []setup.SliceKey{{"mypkg", "myslice2"}},
+	essential2: []setup.SliceKey{{"mypkg", "myslice1"}},
+	error:      `essential loop detected: mypkg_myslice1, mypkg_myslice2`,
+}, {
+	summary: "Default archive must be defined",
+	archive: "foo",
+	error:   `default archive "foo" is not defined`,
+}}
+
+func (s *S) TestValidate(c *C) {
+	for _, test := range validateTests {
+		c.Logf("Summary: %s", test.summary)
+		release := &setup.Release{
+			DefaultArchive: test.archive,
+			Packages: map[string]*setup.Package{
+				"mypkg": {
+					Name: "mypkg",
+					Slices: map[string]*setup.Slice{
+						"myslice1": {
+							Package:   "mypkg",
+							Name:      "myslice1",
+							Essential: test.essential1,
+							Contents:  test.contents,
+						},
+						"myslice2": {
+							Package:   "mypkg",
+							Name:      "myslice2",
+							Essential: test.essential2,
+						},
+					},
+				},
+			},
+		}
+		err := release.Validate()
+		if test.error != "" {
+			c.Assert(err, ErrorMatches, test.error)
+		} else {
+			c.Assert(err, IsNil)
+		}
+	}
+}
+
+func (s *S) TestRequiredBy(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1: {}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					essential:
+						- mypkg1_myslice1
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+		`,
+	})
+
+	keys := []setup.SliceKey{{"mypkg2", "myslice2"}}
+	selection, err := setup.SelectWithOptions(release, keys, &setup.SelectOptions{RecordReasons: true})
+	c.Assert(err, IsNil)
+	chain, ok := selection.RequiredBy(setup.SliceKey{"mypkg1", "myslice1"})
+	c.Assert(ok, Equals, true)
+	c.Assert(chain, DeepEquals, []setup.SliceKey{
+		{"mypkg2", "myslice1"},
+		{"mypkg2", "myslice2"},
+	})
+	chain, ok = selection.RequiredBy(setup.SliceKey{"mypkg2", "myslice1"})
+	c.Assert(ok, Equals, true)
+	c.Assert(chain, DeepEquals, []setup.SliceKey{
+		{"mypkg2", "myslice2"},
+	})
+	chain, ok = selection.RequiredBy(setup.SliceKey{"mypkg2", "myslice2"})
+	c.Assert(ok, Equals, true)
+	c.Assert(chain, HasLen, 0)
+
+	// Slices outside the selection have no known reason.
+	_, ok = selection.RequiredBy(setup.SliceKey{"mypkg9", "myslice9"})
+	c.Assert(ok, Equals, false)
+
+	// Reasons are unknown when they were not recorded.
+	selection, err = setup.Select(release, keys)
+	c.Assert(err, IsNil)
+	_, ok = selection.RequiredBy(setup.SliceKey{"mypkg2", "myslice2"})
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestReasonString(c *C) {
+	c.Assert(setup.Reason{Requested: true}.String(), Equals, "requested")
+	c.Assert(setup.Reason{RequiredBy: setup.SliceKey{"mypkg", "myslice"}}.String(), Equals, "required by mypkg_myslice")
+}
+
+func (s *S) TestTree(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool: {mode: 0755}
+						/usr/lib/tool/**:
+						/etc/tool.d/: {make: true}
+				myslice2:
+					contents:
+						/etc/tool.conf: {text: data}
+						/usr/bin/alias: {symlink: tool, relative: true}
+				myslice3:
+					contents:
+						/opt/other:
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg", "myslice1"}, {"mypkg", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.Tree(), DeepEquals, &setup.TreeNode{
+		Name: "/",
+		Path: "/",
+		Children: []*setup.TreeNode{{
+			Name: "etc",
+			Path: "/etc/",
+			Children: []*setup.TreeNode{{
+				Name: "tool.conf",
+				Path: "/etc/tool.conf",
+				Kind: "text",
+				Info: "data",
+			}, {
+				Name: "tool.d",
+				Path: "/etc/tool.d/",
+				Kind: "dir",
+			}},
+		}, {
+			Name: "usr",
+			Path: "/usr/",
+			Children: []*setup.TreeNode{{
+				Name: "bin",
+				Path: "/usr/bin/",
+				Children: []*setup.TreeNode{{
+					Name: "alias",
+					Path: "/usr/bin/alias",
+					Kind: "symlink",
+					Info: "tool",
+				}, {
+					Name: "tool",
+					Path: "/usr/bin/tool",
+					Kind: "copy",
+					Mode: 0755,
+				}},
+			}, {
+				Name: "lib",
+				Path: "/usr/lib/",
+				Children: []*setup.TreeNode{{
+					Name: "tool",
+					Path: "/usr/lib/tool/",
+					Children: []*setup.TreeNode{{
+						Name: "**",
+						Path: "/usr/lib/tool/**",
+						Kind: "glob",
+					}},
+				}},
+			}},
+		}},
+	})
+}
+
+func (s *S) TestSlicesWithPath(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/passwd: {text: data}
+				myslice2:
+					contents:
+						/etc/group: {text: data}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/passwd: {text: data}
+				myslice2:
+					contents:
+						/etc/shadow*:
+		`,
+	})
+
+	c.Assert(release.SlicesWithPath("/etc/passwd"), DeepEquals, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg2", "myslice1"},
+	})
+	c.Assert(release.SlicesWithPath("/etc/shadow-"), DeepEquals, []setup.SliceKey{
+		{"mypkg2", "myslice2"},
+	})
+	c.Assert(release.SlicesWithPath("/etc/hosts"), HasLen, 0)
+}
+
+func (s *S) TestCanonicalizeGlobs(c *C) {
+	c.Assert(setup.CanonicalizeGlobs([]string{
+		"/usr/lib/foo/**",
+		"/usr/lib/**",
+		"/usr/share/*/copyright",
+		"/usr/share/foo/copyright",
+		"/usr/lib/**",
+		"/usr/bin/foo",
+		"/usr/bin/f*o",
+		"/etc/*.conf",
+		"/etc/foo/*.conf",
+	}), DeepEquals, []string{
+		"/usr/lib/**",
+		"/usr/share/*/copyright",
+		"/usr/bin/f*o",
+		"/etc/*.conf",
+		"/etc/foo/*.conf",
+	})
+}
+
+func (s *S) TestParseModes(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/a: {text: data, mode: 0640}
+						/b: {text: data, mode: "0755"}
+						/c: {text: data, mode: "750"}
+						/d: {text: data, mode: "u+x,go-r"}
+						/e/: {make: true, mode: "o-rx"}
+						/f: {text: data, mode: "04755"}
+						/g: {text: data, mode: 02755}
+						/h/: {make: true, mode: 01777}
+						/i: {text: data, mode: "u+xs"}
+						/j: {text: data, mode: "a=rx,g+s"}
+						/k/: {make: true, mode: "+t"}
+						/l: {text: data, mode: "o+s"}
+						/m: {text: data}
+		`,
+	})
+
+	modes := make(map[string]uint)
+	for path, info := range release.Packages["mypkg"].Slices["myslice"].Contents {
+		modes[path] = info.Mode
+	}
+	c.Assert(modes, DeepEquals, map[string]uint{
+		"/a":  0640,
+		"/b":  0755,
+		"/c":  0750,
+		"/d":  0700,
+		"/e/": 0750,
+		"/f":  04755,
+		"/g":  02755,
+		"/h/": 01777,
+		"/i":  04744,
+		"/j":  02555,
+		"/k/": 01755,
+		"/l":  0644,
+		"/m":  0,
+	})
+}
+
+func (s *S) TestLockDrift(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1: {}
+				myslice2: {}
+		`,
+	})
+
+	lock := &setup.Selection{
+		Slices: []*setup.Slice{
+			{Package: "mypkg", Name: "myslice3"},
+			{Package: "mypkg", Name: "myslice1"},
+			{Package: "otherpkg", Name: "myslice1"},
+		},
+	}
+	c.Assert(setup.LockDrift(lock, release), DeepEquals, []setup.SliceKey{
+		{"mypkg", "myslice3"},
+		{"otherpkg", "myslice1"},
+	})
+
+	lock.Slices = lock.Slices[1:2]
+	c.Assert(setup.LockDrift(lock, release), HasLen, 0)
+}
+
+func (s *S) TestNonExecutableBins(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice:
+					contents:
+						/usr/bin/tool1:
+						/usr/bin/tool2: {mode: 0755}
+						/usr/bin/tool3: {mode: 0644}
+						/usr/sbin/tool4: {text: "#!/bin/sh\n"}
+						/usr/sbin/tool5: {text: "#!/bin/sh\n", mode: 0750}
+						/bin/tool6: {symlink: /usr/bin/tool1}
+						/usr/bin/subdir/data: {mode: 0644}
+						/usr/bin/subdir/: {make: true}
+						/etc/tool.conf: {text: data}
+		`,
+	})
+
+	c.Assert(release.NonExecutableBins(), DeepEquals, []string{
+		"slice mypkg_myslice path /usr/bin/tool3 is in a bin directory but has mode 0644",
+		"slice mypkg_myslice path /usr/sbin/tool4 is in a bin directory but has mode 0644",
+	})
+}
+
+func (s *S) TestExplicitDirs(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/ssl/certs/ca.pem:
+						/var/lib/mydir/: {make: true}
+						/var/cache/: {make: true, mode: 01777}
+				myslice2:
+					essential:
+						- mypkg2_myslice1
+					contents:
+						/opt/other/:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/var/lib/mydir/: {make: true}
+						/run/lock/: {make: true, mode: 0700}
+				myslice2:
+					contents:
+						/srv/: {make: true}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.ExplicitDirs(), DeepEquals, []string{
+		"/run/lock/ 0700",
+		"/var/cache/ 1777",
+		"/var/lib/mydir/ 0755",
+	})
+}
+
+func (s *S) TestUntilMutatePaths(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/etc/foo.conf: {text: foo, until: mutate}
+						/usr/share/foo/**: {until: mutate}
+						/var/lib/foo/: {make: true, until: mutate}
+						/usr/bin/foo:
+						/etc/shared.conf: {text: data, until: mutate}
+				myslice2:
+					contents:
+						/etc/shared.conf: {text: data}
+				myslice3:
+					contents:
+						/etc/other.conf: {text: data, until: mutate}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.UntilMutatePaths(), DeepEquals, []string{
+		"/etc/foo.conf",
+		"/usr/share/foo/**",
+		"/var/lib/foo/",
+	})
+}
+
+func (s *S) TestModeDivergences(c *C) {
+	release := &setup.Release{
+		Packages: map[string]*setup.Package{
+			"mypkg1": {
+				Name: "mypkg1",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg1",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/etc/foo.conf": {Kind: setup.TextPath, Info: "foo", Mode: 0644},
+							"/var/lib/foo/": {Kind: setup.DirPath, Mode: 0755},
+							"/etc/same":     {Kind: setup.TextPath, Info: "same", Mode: 0644},
+							"/etc/other":    {Kind: setup.TextPath, Info: "one", Mode: 0644},
+						},
+					},
+				},
+			},
+			"mypkg2": {
+				Name: "mypkg2",
+				Slices: map[string]*setup.Slice{
+					"myslice1": {
+						Package: "mypkg2",
+						Name:    "myslice1",
+						Contents: map[string]setup.PathInfo{
+							"/etc/foo.conf": {Kind: setup.TextPath, Info: "foo", Mode: 0600},
+							"/var/lib/foo/": {Kind: setup.DirPath, Mode: 0700},
+							"/etc/same":     {Kind: setup.TextPath, Info: "same", Mode: 0644},
+							"/etc/other":    {Kind: setup.TextPath, Info: "two", Mode: 0600},
+						},
+					},
+				},
+			},
+		},
+	}
+	keys := []setup.SliceKey{{"mypkg1", "myslice1"}, {"mypkg2", "myslice1"}}
+
+	_, err := setup.Select(release, keys)
+	c.Assert(err, ErrorMatches, `slices mypkg1_myslice1 and mypkg2_myslice1 conflict on .*`)
+
+	selection, err := setup.SelectWithOptions(release, keys, &setup.SelectOptions{DryRun: true})
+	c.Assert(err, IsNil)
+	c.Assert(selection.ModeDivergences(), DeepEquals, []setup.ModeDivergence{{
+		Path:   "/etc/foo.conf",
+		Slices: keys,
+		Modes:  []uint{0644, 0600},
+	}, {
+		Path:   "/var/lib/foo/",
+		Slices: keys,
+		Modes:  []uint{0755, 0700},
+	}})
+}
+
+func (s *S) TestSlicesForPath(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/foo:
+						/etc/shared.conf: {text: data}
+				myslice2:
+					contents:
+						/usr/lib/foo/**:
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/shared.conf: {text: data}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg1", "myslice2"},
+		{"mypkg2", "myslice1"},
+	})
+	c.Assert(err, IsNil)
+
+	slices := selection.SlicesForPath("/usr/bin/foo")
+	c.Assert(slices, HasLen, 1)
+	c.Assert(slices[0].String(), Equals, "mypkg1_myslice1")
+
+	slices = selection.SlicesForPath("/usr/lib/foo/bar/libfoo.so")
+	c.Assert(slices, HasLen, 1)
+	c.Assert(slices[0].String(), Equals, "mypkg1_myslice2")
+
+	slices = selection.SlicesForPath("/etc/shared.conf")
+	c.Assert(slices, HasLen, 2)
+	c.Assert(slices[0].String(), Equals, "mypkg1_myslice1")
+	c.Assert(slices[1].String(), Equals, "mypkg2_myslice1")
+
+	c.Assert(selection.SlicesForPath("/usr/bin/bar"), HasLen, 0)
+}
+
+func (s *S) TestPaths(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/foo:
+						/etc/foo.d/: {make: true, mode: 0700}
+						/etc/shared.conf: {text: {append: "one\n"}}
+				myslice2:
+					contents:
+						/usr/bin/foo:
+						/var/lib/foo/cache/: {make: true}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice1:
+					contents:
+						/etc/shared.conf: {text: {append: "two\n"}}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg1", "myslice2"},
+		{"mypkg2", "myslice1"},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(selection.Paths(), DeepEquals, map[string]setup.PathInfo{
+		"/usr/bin/foo":        {Kind: setup.CopyPath},
+		"/etc/":               {Kind: setup.DirPath, Mode: 0755},
+		"/etc/foo.d/":         {Kind: setup.DirPath, Mode: 0700},
+		"/etc/shared.conf":    {Kind: setup.TextPath, Info: "one\ntwo\n", Append: true},
+		"/var/":               {Kind: setup.DirPath, Mode: 0755},
+		"/var/lib/":           {Kind: setup.DirPath, Mode: 0755},
+		"/var/lib/foo/":       {Kind: setup.DirPath, Mode: 0755},
+		"/var/lib/foo/cache/": {Kind: setup.DirPath},
+	})
+}
+
+func (s *S) TestPathsForArch(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/foo:
+						/usr/lib/libfoo.so: {arch: amd64}
+						/usr/lib/aarch64-linux-gnu/libfoo.so: {arch: [arm64]}
+		`,
+	})
+
+	selection, err := setup.SelectWithOptions(release, []setup.SliceKey{{"mypkg1", "myslice1"}}, &setup.SelectOptions{
+		Arch: "arm64",
+	})
+	c.Assert(err, IsNil)
+	c.Assert(selection.Paths(), DeepEquals, map[string]setup.PathInfo{
+		"/usr/bin/foo":                         {Kind: setup.CopyPath},
+		"/usr/lib/aarch64-linux-gnu/libfoo.so": {Kind: setup.CopyPath, Arch: []string{"arm64"}},
+	})
+
+	// The release itself is left untouched.
+	c.Assert(release.Packages["mypkg1"].Slices["myslice1"].Contents, HasLen, 3)
+}
+
+func (s *S) TestPathsByKind(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+						/usr/bin/other: {copy: /usr/bin/tool}
+						/etc/config: {text: data}
+						/bin/tool: {symlink: /usr/bin/tool}
+				myslice2:
+					essential:
+						- mypkg1_myslice1
+					contents:
+						/var/lib/tool/: {make: true}
+						/etc/config: {text: data}
+						/usr/lib/tool/**:
+				myslice3:
+					contents:
+						/opt/unselected:
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg1", "myslice2"}})
+	c.Assert(err, IsNil)
+	c.Assert(selection.PathsByKind(), DeepEquals, map[setup.PathKind][]string{
+		setup.CopyPath:    {"/usr/bin/other", "/usr/bin/tool"},
+		setup.TextPath:    {"/etc/config"},
+		setup.SymlinkPath: {"/bin/tool"},
+		setup.DirPath:     {"/var/lib/tool/"},
+		setup.GlobPath:    {"/usr/lib/tool/**"},
+	})
+}
+
+func (s *S) TestNormalizeSliceKeys(c *C) {
+	keys := []setup.SliceKey{
+		{"mypkg2", "myslice1"},
+		{"mypkg1", "myslice2"},
+		{"mypkg2", "myslice1"},
+		{"mypkg1", "myslice1"},
+		{"mypkg1", "myslice2"},
+	}
+	c.Assert(setup.NormalizeSliceKeys(keys), DeepEquals, []setup.SliceKey{
+		{"mypkg1", "myslice1"},
+		{"mypkg1", "myslice2"},
+		{"mypkg2", "myslice1"},
+	})
+	c.Assert(keys[0], Equals, setup.SliceKey{"mypkg2", "myslice1"})
+	c.Assert(setup.NormalizeSliceKeys(nil), HasLen, 0)
+}
+
+var includedTests = []struct {
+	info     setup.PathInfo
+	arch     string
+	included bool
+}{
+	{setup.PathInfo{Kind: setup.CopyPath}, "amd64", true},
+	{setup.PathInfo{Kind: setup.CopyPath, Arch: []string{"amd64"}}, "amd64", true},
+	{setup.PathInfo{Kind: setup.CopyPath, Arch: []string{"amd64"}}, "arm64", false},
+	{setup.PathInfo{Kind: setup.CopyPath, Arch: []string{"i386", "arm64"}}, "arm64", true},
+	{setup.PathInfo{Kind: setup.CopyPath, Arch: []string{"i386", "arm64"}}, "amd64", false},
+}
+
+func (s *S) TestPathInfoIncluded(c *C) {
+	for _, test := range includedTests {
+		c.Logf("Arch: %v, selecting for %s", test.info.Arch, test.arch)
+		c.Assert(test.info.Included(test.arch), Equals, test.included)
+	}
+}
+
+func (s *S) TestSquashfsPseudoFiles(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool: {mode: 0700}
+						/usr/bin/other:
+						/usr/bin/other2: {hardlink: /usr/bin/other}
+						/bin/tool: {symlink: ../usr/bin/tool, relative: true}
+						/var/lib/tool/: {make: true}
+						/var/cache/my tool/: {make: true, mode: 01777}
+						/etc/tool.conf: {text: data, mode: 0600}
+						/etc/tool.d/: {make: true, uid: 100, gid: 101}
+						/etc/tool.d/data: {text: data, uid: 100}
+						/usr/lib/**:
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg", "myslice1"}})
+	c.Assert(err, IsNil)
+	lines, err := selection.SquashfsPseudoFiles()
+	c.Assert(err, IsNil)
+	c.Assert(lines, DeepEquals, []string{
+		"bin/tool s 0777 0 0 ../usr/bin/tool",
+		"etc/tool.conf m 0600 0 0",
+		"etc/tool.d d 0755 100 101",
+		"etc/tool.d/data m 0644 100 0",
+		"usr/bin/other2 l usr/bin/other",
+		"usr/bin/tool m 0700 0 0",
+		`"var/cache/my tool" d 1777 0 0`,
+		"var/lib/tool d 0755 0 0",
+	})
+}
+
+type testArchive struct {
+	pkgs []string
+}
+
+func (a *testArchive) Options() *archive.Options {
+	return &archive.Options{}
+}
+
+func (a *testArchive) Fetch(pkg string) (io.ReadCloser, error) {
+	return nil, nil
+}
+
+func (a *testArchive) Exists(pkg string) bool {
+	for _, p := range a.pkgs {
+		if p == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *S) TestSelectArchivePriorities(c *C) {
+	release := readRelease(c, map[string]string{
+		"chisel.yaml": `
+			format: chisel-v1
+			archives:
+				mirror:
+					version: 22.04
+					components: [main]
+					priority: 20
+					default: true
+				universe:
+					version: 22.04
+					components: [universe]
+					priority: 10
+				other:
+					version: 22.04
+					components: [universe]
+					priority: 10
+		`,
+		"slices/mydir/mypkg1.yaml": `
+			package: mypkg1
+			slices:
+				myslice: {essential: [mypkg2_myslice]}
+		`,
+		"slices/mydir/mypkg2.yaml": `
+			package: mypkg2
+			slices:
+				myslice: {}
+		`,
+		"slices/mydir/mypkg3.yaml": `
+			package: mypkg3
+			slices:
+				myslice: {}
+		`,
+	})
+	keys := []setup.SliceKey{{"mypkg1", "myslice"}}
+
+	archives := map[string]archive.Archive{
+		"mirror":   &testArchive{pkgs: []string{"mypkg1"}},
+		"universe": &testArchive{pkgs: []string{"mypkg1", "mypkg2", "mypkg3"}},
+		"other":    &testArchive{pkgs: []string{"mypkg3"}},
+	}
+
+	// Without archives every package comes from its default archive.
+	selection, err := setup.Select(release, keys)
+	c.Assert(err, IsNil)
+	c.Assert(selection.PackageArchives, IsNil)
+	c.Assert(selection.ArchiveFor("mypkg2"), Equals, "mirror")
+
+	selection, err = setup.SelectWithOptions(release, keys, &setup.SelectOptions{Archives: archives})
+	c.Assert(err, IsNil)
+	c.Assert(selection.PackageArchives, DeepEquals, map[string]string{
+		"mypkg1": "mirror",
+		"mypkg2": "universe",
+	})
+	c.Assert(selection.ArchiveFor("mypkg2"), Equals, "universe")
+
+	_, err = setup.SelectWithOptions(release, []setup.SliceKey{{"mypkg3", "myslice"}}, &setup.SelectOptions{Archives: archives})
+	c.Assert(err, ErrorMatches, `package "mypkg3" is available in archives "other" and "universe" with the same priority`)
+
+	release.Packages["mypkg1"].Archive = "universe"
+	release.Packages["mypkg1"].Pinned = true
+	selection, err = setup.SelectWithOptions(release, keys, &setup.SelectOptions{Archives: archives})
+	c.Assert(err, IsNil)
+	c.Assert(selection.PackageArchives["mypkg1"], Equals, "universe")
+
+	release.Packages["mypkg1"].Archive = "other"
+	_, err = setup.SelectWithOptions(release, keys, &setup.SelectOptions{Archives: archives})
+	c.Assert(err, ErrorMatches, `package "mypkg1" not found in archive "other"`)
+	release.Packages["mypkg1"].Pinned = false
+
+	delete(archives, "universe")
+	_, err = setup.SelectWithOptions(release, keys, &setup.SelectOptions{Archives: archives})
+	c.Assert(err, ErrorMatches, `package "mypkg2" not found in any archive`)
+}
+
+func (s *S) TestTargetPaths(c *C) {
+	release := readRelease(c, map[string]string{
+		"slices/mydir/mypkg.yaml": `
+			package: mypkg
+			slices:
+				myslice1:
+					contents:
+						/usr/bin/tool:
+						/etc/config: {text: data}
+				myslice2:
+					essential:
+						- mypkg_myslice1
+					contents:
+						/var/lib/tool/: {make: true}
+						/etc/config: {text: data}
+		`,
+	})
+
+	selection, err := setup.Select(release, []setup.SliceKey{{"mypkg", "myslice2"}})
+	c.Assert(err, IsNil)
+	paths, err := selection.TargetPaths("/build/root/")
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, map[string]setup.PathInfo{
+		"/build/root/usr/bin/tool":  {Kind: "copy"},
+		"/build/root/etc/config":    {Kind: "text", Info: "data"},
+		"/build/root/var/lib/tool/": {Kind: "dir"},
+	})
+
+	selection = &setup.Selection{
+		Release: release,
+		Slices: []*setup.Slice{{
+			Package: "mypkg",
+			Name:    "myslice3",
+			Contents: map[string]setup.PathInfo{
+				"/../etc/passwd": {Kind: "copy"},
+			},
+		}},
+	}
+	_, err = selection.TargetPaths("/build/root")
+	c.Assert(err, ErrorMatches, `slice mypkg_myslice3 path /../etc/passwd escapes the target root`)
+}
@@ -59,7 +59,6 @@ func Run(options *RunOptions) error {
 		syscall.Umask(oldUmask)
 	}()
 
-	release := options.Selection.Release
 	targetDir := filepath.Clean(options.TargetDir)
 	targetDirAbs := targetDir
 	if !filepath.IsAbs(targetDirAbs) {
@@ -74,7 +73,7 @@ func Run(options *RunOptions) error {
 	for _, slice := range options.Selection.Slices {
 		extractPackage := extract[slice.Package]
 		if extractPackage == nil {
-			archiveName := release.Packages[slice.Package].Archive
+			archiveName := options.Selection.ArchiveFor(slice.Package)
 			archive := options.Archives[archiveName]
 			if archive == nil {
 				return fmt.Errorf("archive %q not defined", archiveName)
@@ -94,7 +93,10 @@ func Run(options *RunOptions) error {
 			if targetPath == "" {
 				continue
 			}
-			if len(pathInfo.Arch) > 0 && !contains(pathInfo.Arch, arch) {
+			if !pathInfo.Included(arch) {
+				continue
+			}
+			if options.Selection.Replaced(slice, targetPath) {
 				continue
 			}
 			if pathInfo.Kind != setup.GlobPath {
@@ -107,7 +109,11 @@ func Run(options *RunOptions) error {
 					sourcePath = targetPath
 				}
 				extractPackage[sourcePath] = append(extractPackage[sourcePath], deb.ExtractInfo{
-					Path: targetPath,
+					Path:     targetPath,
+					Mode:     pathInfo.Mode,
+					Optional: pathInfo.Kind == setup.GlobPath,
+					UID:      pathInfo.UID,
+					GID:      pathInfo.GID,
 				})
 				if sourcePath == copyrightPath && targetPath == copyrightPath {
 					hasCopyright = true
@@ -174,13 +180,38 @@ func Run(options *RunOptions) error {
 
 	// Create new content not coming from packages.
 	done := make(map[string]bool)
+	type hardlink struct {
+		path, target string
+	}
+	var hardlinks []hardlink
 	for _, slice := range options.Selection.Slices {
 		arch := archives[slice.Package].Options().Arch
 		for targetPath, pathInfo := range slice.Contents {
-			if len(pathInfo.Arch) > 0 && !contains(pathInfo.Arch, arch) {
+			if !pathInfo.Included(arch) {
+				continue
+			}
+			if options.Selection.Replaced(slice, targetPath) {
+				continue
+			}
+			if pathInfo.Kind == setup.CopyPath || pathInfo.Kind == setup.GlobPath {
 				continue
 			}
-			if done[targetPath] || pathInfo.Kind == setup.CopyPath || pathInfo.Kind == setup.GlobPath {
+			if pathInfo.Kind == setup.HardlinkPath {
+				// Created below, once all link targets are in place.
+				if !done[targetPath] {
+					done[targetPath] = true
+					hardlinks = append(hardlinks, hardlink{targetPath, pathInfo.Info})
+				}
+				continue
+			}
+			if done[targetPath] {
+				if pathInfo.Append {
+					// Appended text is concatenated in selection order.
+					err := appendText(filepath.Join(targetDir, targetPath), pathInfo.Info)
+					if err != nil {
+						return err
+					}
+				}
 				continue
 			}
 			done[targetPath] = true
@@ -216,6 +247,8 @@ func Run(options *RunOptions) error {
 				Mode: tarHeader.FileInfo().Mode(),
 				Data: fileContent,
 				Link: linkTarget,
+				UID:  pathInfo.UID,
+				GID:  pathInfo.GID,
 			})
 			if err != nil {
 				return err
@@ -223,6 +256,17 @@ func Run(options *RunOptions) error {
 		}
 	}
 
+	for _, link := range hardlinks {
+		err := fsutil.Create(&fsutil.CreateOptions{
+			Path:     filepath.Join(targetDir, link.path),
+			Link:     filepath.Join(targetDir, link.target),
+			Hardlink: true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	// Run mutation scripts. Order is fundamental here as
 	// dependencies must run before dependents.
 	checkWrite := func(path string) error {
@@ -308,11 +352,17 @@ func Run(options *RunOptions) error {
 	return nil
 }
 
-func contains(l []string, s string) bool {
-	for _, si := range l {
-		if si == s {
-			return true
-		}
+func appendText(path, text string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return fmt.Errorf("cannot append to %s: %w", path, err)
+	}
+	_, err = file.WriteString(text)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
-	return false
+	if err != nil {
+		return fmt.Errorf("cannot append to %s: %w", path, err)
+	}
+	return nil
 }
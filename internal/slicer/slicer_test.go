@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 
 	. "gopkg.in/check.v1"
 
@@ -75,7 +77,7 @@ var slicerTests = []slicerTest{{
 					contents:
 						/usr/bin/hello:
 						/usr/bin/hallo: {copy: /usr/bin/hello}
-						/bin/hallo:     {symlink: ../usr/bin/hallo}
+						/bin/hallo:     {symlink: ../usr/bin/hallo, relative: true}
 						/etc/passwd:    {text: data1}
 						/etc/dir/sub/:  {make: true, mode: 01777}
 		`,
@@ -92,6 +94,30 @@ var slicerTests = []slicerTest{{
 		"/etc/dir/sub/":  "dir 01777",
 		"/etc/passwd":    "file 0644 5b41362b",
 	},
+}, {
+	summary: "Hardlinks to extracted and created files",
+	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+						/usr/bin/hallo: {hardlink: /usr/bin/hello}
+						/etc/passwd2:   {hardlink: /etc/passwd}
+						/etc/passwd:    {text: data1}
+		`,
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+		"/usr/bin/hallo": "file 0775 eaf29575",
+		"/etc/":          "dir 0755",
+		"/etc/passwd":    "file 0644 5b41362b",
+		"/etc/passwd2":   "file 0644 5b41362b",
+	},
 }, {
 	summary: "Glob extraction",
 	slices:  []setup.SliceKey{{"base-files", "myslice"}},
@@ -109,6 +135,43 @@ var slicerTests = []slicerTest{{
 		"/usr/bin/":      "dir 0755",
 		"/usr/bin/hello": "file 0775 eaf29575",
 	},
+}, {
+	summary: "Globs matching nothing are allowed",
+	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello:
+						/usr/lib/missing/**:
+						/etd/*.conf:
+		`,
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0775 eaf29575",
+	},
+}, {
+	summary: "Explicit paths take precedence over globs",
+	slices:  []setup.SliceKey{{"base-files", "myslice"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/*:
+						/usr/bin/hello: {mode: 0700}
+		`,
+	},
+	result: map[string]string{
+		"/usr/":          "dir 0755",
+		"/usr/bin/":      "dir 0755",
+		"/usr/bin/hello": "file 0700 eaf29575",
+	},
 }, {
 	summary: "Create new file under extracted directory",
 	slices:  []setup.SliceKey{{"base-files", "myslice"}},
@@ -126,6 +189,27 @@ var slicerTests = []slicerTest{{
 		"/tmp/":    "dir 01777", // This is the magic.
 		"/tmp/new": "file 0644 5b41362b",
 	},
+}, {
+	summary: "Appended text is concatenated in selection order",
+	slices:  []setup.SliceKey{{"base-files", "myslice2"}},
+	release: map[string]string{
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice1:
+					contents:
+						/etc/hosts: {text: {append: "line1\n"}}
+				myslice2:
+					essential:
+						- base-files_myslice1
+					contents:
+						/etc/hosts: {text: {append: "line2\n"}}
+		`,
+	},
+	result: map[string]string{
+		"/etc/":      "dir 0755",
+		"/etc/hosts": "file 0644 2751a3a2",
+	},
 }, {
 	summary: "Create new nested file under extracted directory",
 	slices:  []setup.SliceKey{{"base-files", "myslice"}},
@@ -311,7 +395,8 @@ var slicerTests = []slicerTest{{
 						/tmp/file1: {text: data1}
 				myslice2:
 					mutate: |
-						content.read("/tmp/file1")
+						path = "/tmp/" + "file1"
+						content.read(path)
 		`,
 	},
 	error: `slice base-files_myslice2: cannot read file which is not selected: /tmp/file1`,
@@ -326,6 +411,8 @@ var slicerTests = []slicerTest{{
 					contents:
 						/usr/bin/*:
 				myslice2:
+					essential:
+						- base-files_myslice1
 					mutate: |
 						content.read("/usr/bin/hello")
 		`,
@@ -585,3 +672,65 @@ func (s *S) TestRun(c *C) {
 		}
 	}
 }
+
+func (s *S) TestRunOwnership(c *C) {
+	if os.Getuid() != 0 {
+		c.Skip("changing ownership requires root")
+	}
+
+	releaseDir := c.MkDir()
+	release := map[string]string{
+		"chisel.yaml": defaultChiselYaml,
+		"slices/mydir/base-files.yaml": `
+			package: base-files
+			slices:
+				myslice:
+					contents:
+						/usr/bin/hello: {mode: 04755, uid: 100, gid: 101}
+						/etc/passwd:    {text: data1, uid: 102}
+						/etc/dir/:      {make: true, gid: 103}
+						/bin/hello:     {symlink: /usr/bin/hello, uid: 104, gid: 105}
+		`,
+	}
+	for path, data := range release {
+		fpath := filepath.Join(releaseDir, path)
+		err := os.MkdirAll(filepath.Dir(fpath), 0755)
+		c.Assert(err, IsNil)
+		err = ioutil.WriteFile(fpath, testutil.Reindent(data), 0644)
+		c.Assert(err, IsNil)
+	}
+	r, err := setup.ReadRelease(releaseDir)
+	c.Assert(err, IsNil)
+	selection, err := setup.Select(r, []setup.SliceKey{{"base-files", "myslice"}})
+	c.Assert(err, IsNil)
+
+	targetDir := c.MkDir()
+	err = slicer.Run(&slicer.RunOptions{
+		Selection: selection,
+		Archives: map[string]archive.Archive{
+			"ubuntu": &testArchive{pkgs: map[string][]byte{
+				"base-files": testutil.PackageData["base-files"],
+			}},
+		},
+		TargetDir: targetDir,
+	})
+	c.Assert(err, IsNil)
+
+	owners := map[string][2]uint32{
+		"/usr/bin/hello": {100, 101},
+		"/etc/passwd":    {102, 0},
+		"/etc/dir":       {0, 103},
+		"/bin/hello":     {104, 105},
+		"/usr/bin":       {0, 0},
+	}
+	for path, owner := range owners {
+		fileinfo, err := os.Lstat(filepath.Join(targetDir, path))
+		c.Assert(err, IsNil)
+		stat := fileinfo.Sys().(*syscall.Stat_t)
+		c.Assert([2]uint32{stat.Uid, stat.Gid}, Equals, owner, Commentf("path %s", path))
+	}
+
+	fileinfo, err := os.Stat(filepath.Join(targetDir, "/usr/bin/hello"))
+	c.Assert(err, IsNil)
+	c.Assert(fileinfo.Mode(), Equals, 0755|fs.ModeSetuid)
+}